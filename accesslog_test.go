@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// accessRecords - записи лога запросов, по одной json на строку
+func accessRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("bad log line %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	api := NewMyApi(testAuth).WithLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	cases := []struct {
+		name   string
+		url    string
+		header map[string]string
+		status int
+		level  string
+		attrs  map[string]interface{}
+	}{
+		{
+			name:   "ok",
+			url:    ApiUserProfile + "?login=rvasily",
+			header: map[string]string{"X-Request-Id": "req-1"},
+			status: http.StatusOK,
+			level:  "INFO",
+			attrs: map[string]interface{}{
+				"api": "MyApi", "endpoint": "Profile", "method": "GET",
+				"path": ApiUserProfile, "status": 200.0, "request_id": "req-1",
+			},
+		},
+		{
+			name:   "validation failure",
+			url:    ApiUserProfile,
+			status: http.StatusBadRequest,
+			level:  "WARN",
+			attrs:  map[string]interface{}{"status": 400.0, "invalid_param": "login"},
+		},
+		{
+			name:   "not found",
+			url:    ApiUserProfile + "?login=nobody",
+			status: http.StatusNotFound,
+			level:  "WARN",
+			attrs:  map[string]interface{}{"status": 404.0},
+		},
+	}
+	for _, tc := range cases {
+		buf.Reset()
+		req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		for name, value := range tc.header {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("[%s] expected status %d, got %d", tc.name, tc.status, w.Code)
+		}
+
+		records := accessRecords(t, &buf)
+		if len(records) != 1 {
+			t.Fatalf("[%s] expected one record, got %v", tc.name, records)
+		}
+		if records[0]["level"] != tc.level {
+			t.Errorf("[%s] expected level %s, got %v", tc.name, tc.level, records[0]["level"])
+		}
+		for name, value := range tc.attrs {
+			if records[0][name] != value {
+				t.Errorf("[%s] expected %s=%v, got %v", tc.name, name, value, records[0][name])
+			}
+		}
+		if _, ok := records[0]["duration"]; !ok {
+			t.Errorf("[%s] no duration in %v", tc.name, records[0])
+		}
+		if records[0]["request_id"] != w.Header().Get("X-Request-Id") {
+			t.Errorf("[%s] request id in log %v and response %q differ", tc.name, records[0]["request_id"], w.Header().Get("X-Request-Id"))
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	api := NewMyApi(testAuth)
+	seen := map[string]bool{}
+	for _, incoming := range []string{"", "", "has space", strings.Repeat("x", 200)} {
+		req := httptest.NewRequest(http.MethodGet, ApiUserProfile+"?login=rvasily", nil)
+		if incoming != "" {
+			req.Header.Set("X-Request-Id", incoming)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+
+		id := w.Header().Get("X-Request-Id")
+		if len(id) != 32 || seen[id] {
+			t.Errorf("expected new 32 char id for %q, got %q", incoming, id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestAccessLogPrincipal(t *testing.T) {
+	var buf bytes.Buffer
+	api := NewMyApi(testAuth).WithLogger(slog.New(slog.NewJSONHandler(&buf, nil)))
+	// так principal кладёт middleware аутентификации
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		api.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), "rvasily")))
+	})
+
+	req := httptest.NewRequest(http.MethodGet, ApiUserProfile+"?login=rvasily", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if records := accessRecords(t, &buf); len(records) != 1 || records[0]["principal"] != "rvasily" {
+		t.Errorf("expected principal in %v", records)
+	}
+}
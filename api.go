@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
-	"sync"
+	"strconv"
+	"time"
 )
 
 // вы можете использовать ApiError в коде, который получается в результате генерации
@@ -12,12 +15,25 @@ import (
 type ApiError struct {
 	HTTPStatus int
 	Err        error
+	// Code - стабильный машинный код ошибки, по нему клиенты отличают ошибки
+	// вместо сравнения текста. Попадает в "code" ответа
+	Code string
+	// Details - необязательные подробности, попадают в "details" ответа
+	Details map[string]interface{}
 }
 
 func (ae ApiError) Error() string {
 	return ae.Err.Error()
 }
 
+func (ae ApiError) ErrorCode() string {
+	return ae.Code
+}
+
+func (ae ApiError) ErrorDetails() map[string]interface{} {
+	return ae.Details
+}
+
 // ----------------
 
 const (
@@ -26,33 +42,83 @@ const (
 	statusAdmin     = 20
 )
 
+// внутренние клиенты могут попросить компактный ответ через Accept,
+// браузерные ходят с app.example.com
+// apigen:api {"encoders": ["json", "msgpack", "binpack"], "metrics": true, "health": "/user/", "max_body": "64KB", "cors": {"origins": ["https://app.example.com"], "headers": ["Content-Type", "X-Auth", "If-Match", "If-None-Match", "Idempotency-Key"], "expose": ["ETag", "Retry-After", "X-Next-Cursor", "X-Request-Id"], "max_age": 600}}
 type MyApi struct {
-	statuses map[string]int
-	users    map[string]*User
-	nextID   uint64
-	mu       *sync.RWMutex
+	statuses    map[string]int
+	store       UserStore
+	idempotency IdempotencyStore
+	// accessLog - куда обёртки пишут запросы, nil - никуда
+	accessLog *slog.Logger
+	// tracer - span на запрос, nil - без трейсинга
+	tracer Tracer
+	// auth - секреты X-Auth для методов с "auth": true
+	auth AuthSecrets
+	// limiter - корзины "rate_limit" этого экземпляра
+	limiter RateLimiter
+	// limits - лимиты вместо "rate_limit" из меток, nil - как в метках
+	limits RateLimits
+	// origins - origins вместо "cors" из метки, nil - как в метке
+	origins CORSOrigins
 }
 
-func NewMyApi() *MyApi {
+// NewMyApi - MyApi с одним админом в памяти. Методы с "auth": true
+// пускают только с секретами secrets
+func NewMyApi(secrets AuthSecrets) *MyApi {
+	return NewMyApiWithStore(NewMemoryUserStore(&User{
+		ID:       42,
+		Login:    "rvasily",
+		FullName: "Vasily Romanov",
+		Status:   statusAdmin,
+	}), secrets)
+}
+
+// NewMyApiWithStore - MyApi поверх своего хранилища, например FileUserStore
+func NewMyApiWithStore(store UserStore, secrets AuthSecrets) *MyApi {
 	return &MyApi{
 		statuses: map[string]int{
 			"user":      0,
 			"moderator": 10,
 			"admin":     20,
 		},
-		users: map[string]*User{
-			"rvasily": &User{
-				ID:       42,
-				Login:    "rvasily",
-				FullName: "Vasily Romanov",
-				Status:   statusAdmin,
-			},
-		},
-		nextID: 43,
-		mu:     &sync.RWMutex{},
+		store:       store,
+		idempotency: NewMemoryIdempotencyStore(24 * time.Hour),
+		auth:        secrets,
+		limiter:     NewMemoryRateLimiter(),
 	}
 }
 
+// WithLogger - запросы к MyApi пишутся в logger
+func (srv *MyApi) WithLogger(logger *slog.Logger) *MyApi {
+	srv.accessLog = logger
+	return srv
+}
+
+// WithRateLimits - лимиты методов MyApi вместо "rate_limit" из меток
+func (srv *MyApi) WithRateLimits(limits RateLimits) *MyApi {
+	srv.limits = limits
+	return srv
+}
+
+// WithCORS - браузерам с этих origins можно в MyApi вместо origins из метки
+func (srv *MyApi) WithCORS(origins CORSOrigins) *MyApi {
+	srv.origins = origins
+	return srv
+}
+
+// WithTracer - запросы к MyApi попадают в span'ы tracer
+func (srv *MyApi) WithTracer(tracer Tracer) *MyApi {
+	srv.tracer = tracer
+	return srv
+}
+
+// Ready - для /user/readyz: хранилище отвечает
+func (srv *MyApi) Ready(ctx context.Context) error {
+	_, err := srv.store.List(ctx, 0, 1)
+	return err
+}
+
 type ProfileParams struct {
 	Login string `apivalidator:"required"`
 }
@@ -64,58 +130,190 @@ type CreateParams struct {
 	Age    int    `apivalidator:"min=0,max=128"`
 }
 
+type UpdateParams struct {
+	Login  string `apivalidator:"required"`
+	Name   string `apivalidator:"paramname=full_name"`
+	Status string `apivalidator:"enum=user|moderator|admin"`
+}
+
+type DeleteParams struct {
+	Login string `apivalidator:"required"`
+}
+
+type ListParams struct {
+	Limit  int `apivalidator:"min=1,max=100,default=20"`
+	Cursor string
+}
+
 type User struct {
 	ID       uint64 `json:"id"`
 	Login    string `json:"login"`
 	FullName string `json:"full_name"`
 	Status   int    `json:"status"`
+	// Version растёт с каждым изменением, из него строится ETag
+	Version uint64 `json:"version"`
+}
+
+func (u *User) ETag() string {
+	return fmt.Sprintf(`"%d-%d"`, u.ID, u.Version)
 }
 
 type NewUser struct {
 	ID uint64 `json:"id"`
 }
 
-// apigen:api {"url": "/user/profile", "auth": false}
+// apigen:api {"url": "/user/profile", "auth": false, "etag": true, "timeout": "2s"}
 func (srv *MyApi) Profile(ctx context.Context, in ProfileParams) (*User, error) {
 
 	if in.Login == "bad_user" {
 		return nil, fmt.Errorf("bad user")
 	}
 
-	srv.mu.RLock()
-	user, exist := srv.users[in.Login]
-	srv.mu.RUnlock()
-	if !exist {
-		return nil, ApiError{http.StatusNotFound, fmt.Errorf("user not exist")}
+	user, err := srv.store.Get(ctx, in.Login)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, userNotFound(in.Login)
+	}
+	if err != nil {
+		return nil, err
 	}
 
 	return user, nil
 }
 
-// apigen:api {"url": "/user/create", "auth": true, "method": "POST"}
+func userNotFound(login string) ApiError {
+	return ApiError{
+		HTTPStatus: http.StatusNotFound,
+		Err:        fmt.Errorf("user not exist"),
+		Code:       "user_not_found",
+		Details:    map[string]interface{}{"login": login},
+	}
+}
+
+// мобильные клиенты повторяют запрос при обрыве - с Idempotency-Key
+// повтор получает первый ответ, а не 409
+// apigen:api {"url": "/user/create", "auth": true, "method": "POST", "idempotent": true, "rate_limit": "10/s", "burst": 20, "strict": true}
 func (srv *MyApi) Create(ctx context.Context, in CreateParams) (*NewUser, error) {
 	if in.Login == "bad_username" {
 		return nil, fmt.Errorf("bad user")
 	}
 
-	srv.mu.Lock()
-	defer srv.mu.Unlock()
-
-	_, exist := srv.users[in.Login]
-	if exist {
-		return nil, ApiError{http.StatusConflict, fmt.Errorf("user %s exist", in.Login)}
-	}
-
-	id := srv.nextID
-	srv.nextID++
-	srv.users[in.Login] = &User{
-		ID:       id,
+	user, err := srv.store.Create(ctx, &User{
 		Login:    in.Login,
 		FullName: in.Name,
 		Status:   srv.statuses[in.Status],
+	})
+	if errors.Is(err, ErrUserExists) {
+		return nil, ApiError{
+			HTTPStatus: http.StatusConflict,
+			Err:        fmt.Errorf("user %s exist", in.Login),
+			Code:       "user_exists",
+			Details:    map[string]interface{}{"login": in.Login},
+		}
 	}
 
-	return &NewUser{id}, nil
+	if err != nil {
+		return nil, err
+	}
+
+	return &NewUser{user.ID}, nil
+}
+
+// пустые full_name и status оставляют как было
+// If-Match сверяется с ETag пользователя до изменения
+// apigen:api {"url": "/user/update", "auth": true, "method": "POST", "etag": true, "strict": true}
+func (srv *MyApi) Update(ctx context.Context, in UpdateParams) (*User, error) {
+	user, err := srv.store.Get(ctx, in.Login)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, userNotFound(in.Login)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkApiIfMatch(ctx, user.ETag()); err != nil {
+		return nil, err
+	}
+
+	if in.Name != "" {
+		user.FullName = in.Name
+	}
+	if in.Status != "" {
+		status, ok := srv.statuses[in.Status]
+		if !ok {
+			return nil, ApiError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("unknown status %s", in.Status),
+				Code:       "param_not_in_enum",
+				Details:    map[string]interface{}{"param": "status"},
+			}
+		}
+		user.Status = status
+	}
+
+	user, err = srv.store.Update(ctx, user)
+	if errors.Is(err, ErrUserNotFound) {
+		// удалили, пока меняли
+		return nil, userNotFound(in.Login)
+	}
+	if errors.Is(err, ErrVersionConflict) {
+		return nil, ApiError{
+			HTTPStatus: http.StatusConflict,
+			Err:        fmt.Errorf("user %s was changed concurrently", in.Login),
+			Code:       "version_conflict",
+			Details:    map[string]interface{}{"login": in.Login},
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// в ответе - удалённый пользователь
+// apigen:api {"url": "/user/delete", "auth": true, "method": "POST", "etag": true}
+func (srv *MyApi) Delete(ctx context.Context, in DeleteParams) (*User, error) {
+	user, err := srv.store.Get(ctx, in.Login)
+	if err == nil {
+		err = checkApiIfMatch(ctx, user.ETag())
+	}
+	if err == nil {
+		err = srv.store.Delete(ctx, in.Login)
+	}
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, userNotFound(in.Login)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// курсор - id последнего пользователя на странице, пустой на последней
+// apigen:api {"url": "/user/list", "method": "GET", "timeout": "5s"}
+func (srv *MyApi) List(ctx context.Context, in ListParams) ([]*User, string, error) {
+	var after uint64
+	if in.Cursor != "" {
+		id, err := strconv.ParseUint(in.Cursor, 10, 64)
+		if err != nil {
+			return nil, "", ApiError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("bad cursor"),
+				Code:       "bad_cursor",
+				Details:    map[string]interface{}{"cursor": in.Cursor},
+			}
+		}
+		after = id
+	}
+
+	// на один больше, чтобы знать, есть ли следующая страница
+	users, err := srv.store.List(ctx, after, in.Limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(users) <= in.Limit {
+		return users, "", nil
+	}
+	users = users[:in.Limit]
+	return users, strconv.FormatUint(users[len(users)-1].ID, 10), nil
 }
 
 // 2-я часть
@@ -123,11 +321,21 @@ func (srv *MyApi) Create(ctx context.Context, in CreateParams) (*NewUser, error)
 // код, созданный вашим кодогенератором работает с конкретной струткурой, про другие ничего не знает
 // поэтому то что рядом есть ещё походая структура с такими же методами его нисколько не смущает
 
+// apigen:api {"metrics": true, "health": "/user/"}
 type OtherApi struct {
+	accessLog *slog.Logger
+	auth      AuthSecrets
 }
 
-func NewOtherApi() *OtherApi {
-	return &OtherApi{}
+// NewOtherApi - методы с "auth": true пускают только с секретами secrets
+func NewOtherApi(secrets AuthSecrets) *OtherApi {
+	return &OtherApi{auth: secrets}
+}
+
+// WithLogger - запросы к OtherApi пишутся в logger
+func (srv *OtherApi) WithLogger(logger *slog.Logger) *OtherApi {
+	srv.accessLog = logger
+	return srv
 }
 
 type OtherCreateParams struct {
@@ -153,3 +361,18 @@ func (srv *OtherApi) Create(ctx context.Context, in OtherCreateParams) (*OtherUs
 		Level:    in.Level,
 	}, nil
 }
+
+type WhoamiParams struct {
+}
+
+type Caller struct {
+	Principal string `json:"principal"`
+}
+
+// внутренние сервисы ходят в OtherApi с клиентскими сертификатами,
+// по whoami можно проверить, кем их видит сервер
+// apigen:api {"url": "/user/whoami", "auth": "mtls"}
+func (srv *OtherApi) Whoami(ctx context.Context, in WhoamiParams) (*Caller, error) {
+	principal, _ := PrincipalFromContext(ctx)
+	return &Caller{Principal: principal}, nil
+}
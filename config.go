@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config - настройки сервера. Берутся из json-файла (-config или API_CONFIG),
+// поверх него - переменные окружения API_*, поверх них - флаги.
+// Всё проверяется при запуске: опечатка в файле - ошибка, а не значение по-умолчанию
+type config struct {
+	Server serverConfig `json:"server"`
+	// Auth - principal -> секрет X-Auth для методов с "auth": true
+	Auth AuthSecrets `json:"auth"`
+	// RateLimits - "MyApi.Create" -> лимит вместо указанного в метке
+	RateLimits map[string]rateLimitConfig `json:"rate_limits"`
+	CORS       corsConfig                 `json:"cors"`
+	Log        logConfig                  `json:"log"`
+	Store      storeConfig                `json:"store"`
+}
+
+// serverConfig - где слушать и сколько ждать. ReadHeaderTimeout - только
+// заголовки, короткий: медленный клиент не держит соединение до ReadTimeout.
+// WriteTimeout считается от начала запроса, потоки NDJSON сдвигают его сами
+type serverConfig struct {
+	Addr              string    `json:"addr"`
+	ReadHeaderTimeout duration  `json:"read_header_timeout"`
+	ReadTimeout       duration  `json:"read_timeout"`
+	WriteTimeout      duration  `json:"write_timeout"`
+	IdleTimeout       duration  `json:"idle_timeout"`
+	ShutdownTimeout   duration  `json:"shutdown_timeout"`
+	TLS               tlsConfig `json:"tls"`
+}
+
+// tlsConfig - сертификат и ключ сервера в PEM. ClientCA - центр, которым
+// подписаны сертификаты внутренних клиентов: с ним сервер проверяет
+// сертификат, если клиент его прислал, а методы с "auth": "mtls" без
+// проверенного сертификата не пускают
+type tlsConfig struct {
+	Cert     string `json:"cert"`
+	Key      string `json:"key"`
+	ClientCA string `json:"client_ca"`
+}
+
+// rateLimitConfig - "rate": "10/s" (s, m, h), как в метке apigen:api
+type rateLimitConfig struct {
+	Rate  string `json:"rate"`
+	Burst int    `json:"burst"`
+}
+
+// corsConfig - origins вместо указанных в метках, пустой - как в метках
+type corsConfig struct {
+	Origins []string `json:"origins"`
+}
+
+// storeConfig - журнал пользователей FileUserStore, пустой path - пользователи
+// в памяти и пропадают при перезапуске
+type storeConfig struct {
+	Path string `json:"path"`
+}
+
+type logConfig struct {
+	Level string `json:"level"`
+}
+
+// duration - time.Duration строкой "5s" в json
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("duration must be a string like \"5s\": %w", err)
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil {
+		return err
+	}
+	d.Duration = value
+	return nil
+}
+
+func defaultConfig() config {
+	return config{
+		Server: serverConfig{
+			Addr:              ":8080",
+			ReadHeaderTimeout: duration{2 * time.Second},
+			ReadTimeout:       duration{5 * time.Second},
+			WriteTimeout:      duration{10 * time.Second},
+			IdleTimeout:       duration{time.Minute},
+			ShutdownTimeout:   duration{15 * time.Second},
+		},
+		Log: logConfig{Level: "info"},
+	}
+}
+
+// loadConfig собирает настройки из файла, окружения и флагов args и проверяет их.
+// getenv - os.Getenv, в тестах - map
+func loadConfig(args []string, getenv func(string) string) (config, error) {
+	cfg := defaultConfig()
+
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	path := flags.String("config", "", "json-файл настроек (API_CONFIG)")
+	addr := flags.String("addr", "", "адрес сервера (API_ADDR)")
+	level := flags.String("log-level", "", "debug, info, warn или error (API_LOG_LEVEL)")
+	tlsCert := flags.String("tls-cert", "", "сертификат сервера в PEM, с ним сервер отвечает по https (API_TLS_CERT)")
+	tlsKey := flags.String("tls-key", "", "ключ сертификата сервера (API_TLS_KEY)")
+	tlsClientCA := flags.String("tls-client-ca", "", "центр сертификации клиентов для mtls (API_TLS_CLIENT_CA)")
+	storePath := flags.String("store-path", "", "журнал пользователей, без него - в памяти (API_STORE_PATH)")
+	timeouts := []struct {
+		env, flag, usage string
+		value            *duration
+		override         *time.Duration
+	}{
+		{"API_READ_HEADER_TIMEOUT", "read-header-timeout", "сколько читать заголовки запроса", &cfg.Server.ReadHeaderTimeout, new(time.Duration)},
+		{"API_READ_TIMEOUT", "read-timeout", "сколько читать запрос вместе с телом", &cfg.Server.ReadTimeout, new(time.Duration)},
+		{"API_WRITE_TIMEOUT", "write-timeout", "сколько писать ответ", &cfg.Server.WriteTimeout, new(time.Duration)},
+		{"API_IDLE_TIMEOUT", "idle-timeout", "сколько держать keep-alive соединение без запросов", &cfg.Server.IdleTimeout, new(time.Duration)},
+		{"API_SHUTDOWN_TIMEOUT", "shutdown-timeout", "сколько ждать запросы в работе при остановке", &cfg.Server.ShutdownTimeout, new(time.Duration)},
+	}
+	for _, t := range timeouts {
+		flags.DurationVar(t.override, t.flag, 0, t.usage+" ("+t.env+")")
+	}
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+	if flags.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected arguments %v", flags.Args())
+	}
+
+	if *path == "" {
+		*path = getenv("API_CONFIG")
+	}
+	if *path != "" {
+		data, err := os.ReadFile(*path)
+		if err != nil {
+			return cfg, err
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("%s: %w", *path, err)
+		}
+	}
+
+	if err := cfg.fromEnv(getenv); err != nil {
+		return cfg, err
+	}
+	for _, t := range timeouts {
+		raw := getenv(t.env)
+		if raw == "" {
+			continue
+		}
+		value, err := time.ParseDuration(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("%s: %w", t.env, err)
+		}
+		t.value.Duration = value
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.Server.Addr = *addr
+		case "log-level":
+			cfg.Log.Level = *level
+		case "tls-cert":
+			cfg.Server.TLS.Cert = *tlsCert
+		case "tls-key":
+			cfg.Server.TLS.Key = *tlsKey
+		case "tls-client-ca":
+			cfg.Server.TLS.ClientCA = *tlsClientCA
+		case "store-path":
+			cfg.Store.Path = *storePath
+		}
+		for _, t := range timeouts {
+			if f.Name == t.flag {
+				t.value.Duration = *t.override
+			}
+		}
+	})
+	return cfg, cfg.validate()
+}
+
+// fromEnv - переменные окружения поверх файла. Списки - через запятую,
+// API_AUTH_SECRETS - "principal:секрет", API_RATE_LIMITS - "MyApi.Create=10/s:20"
+func (cfg *config) fromEnv(getenv func(string) string) error {
+	if addr := getenv("API_ADDR"); addr != "" {
+		cfg.Server.Addr = addr
+	}
+	if level := getenv("API_LOG_LEVEL"); level != "" {
+		cfg.Log.Level = level
+	}
+	for env, value := range map[string]*string{
+		"API_TLS_CERT":      &cfg.Server.TLS.Cert,
+		"API_TLS_KEY":       &cfg.Server.TLS.Key,
+		"API_TLS_CLIENT_CA": &cfg.Server.TLS.ClientCA,
+		"API_STORE_PATH":    &cfg.Store.Path,
+	} {
+		if path := getenv(env); path != "" {
+			*value = path
+		}
+	}
+	if origins := getenv("API_CORS_ORIGINS"); origins != "" {
+		cfg.CORS.Origins = strings.Split(origins, ",")
+	}
+	if secrets := getenv("API_AUTH_SECRETS"); secrets != "" {
+		cfg.Auth = AuthSecrets{}
+		for _, item := range strings.Split(secrets, ",") {
+			principal, secret, ok := strings.Cut(item, ":")
+			if !ok {
+				return fmt.Errorf("API_AUTH_SECRETS: expected principal:secret, got %q", item)
+			}
+			cfg.Auth[principal] = secret
+		}
+	}
+	if limits := getenv("API_RATE_LIMITS"); limits != "" {
+		cfg.RateLimits = map[string]rateLimitConfig{}
+		for _, item := range strings.Split(limits, ",") {
+			name, limit, _ := strings.Cut(item, "=")
+			rate, burst, _ := strings.Cut(limit, ":")
+			n := 0
+			if burst != "" {
+				var err error
+				if n, err = strconv.Atoi(burst); err != nil {
+					return fmt.Errorf("API_RATE_LIMITS: bad burst in %q", item)
+				}
+			}
+			cfg.RateLimits[name] = rateLimitConfig{Rate: rate, Burst: n}
+		}
+	}
+	return nil
+}
+
+// validate - все ошибки настроек разом, чтобы не чинить их по одной
+func (cfg *config) validate() error {
+	var errs []error
+	if cfg.Server.Addr == "" {
+		errs = append(errs, errors.New("server.addr is empty"))
+	}
+	for name, d := range map[string]duration{
+		"server.read_header_timeout": cfg.Server.ReadHeaderTimeout,
+		"server.read_timeout":        cfg.Server.ReadTimeout,
+		"server.write_timeout":       cfg.Server.WriteTimeout,
+		"server.idle_timeout":        cfg.Server.IdleTimeout,
+		"server.shutdown_timeout":    cfg.Server.ShutdownTimeout,
+	} {
+		if d.Duration <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be > 0", name))
+		}
+	}
+
+	if (cfg.Server.TLS.Cert == "") != (cfg.Server.TLS.Key == "") {
+		errs = append(errs, errors.New("server.tls: cert and key must be set together"))
+	}
+	if cfg.Server.TLS.ClientCA != "" && cfg.Server.TLS.Cert == "" {
+		errs = append(errs, errors.New("server.tls: client_ca requires cert and key, mtls works only over https"))
+	}
+
+	// без секретов методы с "auth": true не пустят никого - скорее всего забыли
+	if len(cfg.Auth) == 0 {
+		errs = append(errs, errors.New("auth: no secrets, set them in the config file or API_AUTH_SECRETS"))
+	}
+	seen := map[string]string{}
+	for principal, secret := range cfg.Auth {
+		switch {
+		case principal == "":
+			errs = append(errs, errors.New("auth: empty principal"))
+		case secret == "":
+			errs = append(errs, fmt.Errorf("auth: empty secret for %q", principal))
+		case seen[secret] != "":
+			errs = append(errs, fmt.Errorf("auth: %q and %q share a secret", seen[secret], principal))
+		}
+		seen[secret] = principal
+	}
+
+	for name, limit := range cfg.RateLimits {
+		if _, err := limit.parse(); err != nil {
+			errs = append(errs, fmt.Errorf("rate_limits.%s: %w", name, err))
+		}
+	}
+	// метод без "rate_limit" в метке - тоже ошибка запуска
+	if err := cfg.rateLimits().Check(); err != nil {
+		errs = append(errs, fmt.Errorf("rate_limits: %w", err))
+	}
+	for _, origin := range cfg.CORS.Origins {
+		if origin == "" {
+			errs = append(errs, errors.New("cors.origins: empty origin"))
+		}
+	}
+	if err := CORSOrigins(cfg.CORS.Origins).Check(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := cfg.logLevel(); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// parse разбирает "10/s" в RateLimit. burst по-умолчанию - число из rate
+func (limit rateLimitConfig) parse() (RateLimit, error) {
+	count, unit, ok := strings.Cut(limit.Rate, "/")
+	n, err := strconv.Atoi(count)
+	per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[unit]
+	if !ok || err != nil || n <= 0 || per == 0 || limit.Burst < 0 {
+		return RateLimit{}, fmt.Errorf("bad rate %q, expected like \"10/s\", \"100/m\" or \"1000/h\"", limit.Rate)
+	}
+	burst := limit.Burst
+	if burst == 0 {
+		burst = n
+	}
+	return RateLimit{Rate: float64(n) / per.Seconds(), Burst: burst}, nil
+}
+
+func (cfg *config) logLevel() (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(cfg.Log.Level))
+	return level, err
+}
+
+// rateLimits - лимиты из настроек для WithRateLimits, nil - как в метках.
+// Неразобранные пропускает, о них уже сказал validate
+func (cfg *config) rateLimits() RateLimits {
+	if len(cfg.RateLimits) == 0 {
+		return nil
+	}
+	limits := RateLimits{}
+	for name, limit := range cfg.RateLimits {
+		if parsed, err := limit.parse(); err == nil {
+			limits[name] = parsed
+		}
+	}
+	return limits
+}
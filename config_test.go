@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testConfig = `{
+	"server": {"addr": ":9000", "read_timeout": "3s"},
+	"auth": {"ci-bot": "s3cr3t", "admin": "t0p"},
+	"rate_limits": {"MyApi.Create": {"rate": "600/m", "burst": 50}},
+	"cors": {"origins": ["https://admin.example.com"]},
+	"log": {"level": "debug"}
+}`
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	cases := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		addr    string
+		read    time.Duration
+		write   time.Duration
+		secrets int
+		level   string
+	}{
+		{
+			name: "file", args: []string{"-config", path},
+			addr: ":9000", read: 3 * time.Second, write: 10 * time.Second, secrets: 2, level: "debug",
+		},
+		{
+			name: "file from env", env: map[string]string{"API_CONFIG": path},
+			addr: ":9000", read: 3 * time.Second, write: 10 * time.Second, secrets: 2, level: "debug",
+		},
+		{
+			name: "env over file",
+			env:  map[string]string{"API_CONFIG": path, "API_ADDR": ":9090", "API_WRITE_TIMEOUT": "1s", "API_AUTH_SECRETS": "only:one", "API_LOG_LEVEL": "warn"},
+			addr: ":9090", read: 3 * time.Second, write: time.Second, secrets: 1, level: "warn",
+		},
+		{
+			name: "flags over env",
+			args: []string{"-addr", "127.0.0.1:7070", "-read-timeout", "2s", "-log-level", "error"},
+			env:  map[string]string{"API_CONFIG": path, "API_ADDR": ":9090", "API_READ_TIMEOUT": "1s"},
+			addr: "127.0.0.1:7070", read: 2 * time.Second, write: 10 * time.Second, secrets: 2, level: "error",
+		},
+		{
+			name: "no file",
+			env:  map[string]string{"API_AUTH_SECRETS": "dev:100500"},
+			addr: ":8080", read: 5 * time.Second, write: 10 * time.Second, secrets: 1, level: "info",
+		},
+	}
+	for _, tc := range cases {
+		cfg, err := loadConfig(tc.args, func(name string) string { return tc.env[name] })
+		if err != nil {
+			t.Errorf("[%s] unexpected error %v", tc.name, err)
+			continue
+		}
+		if cfg.Server.Addr != tc.addr || cfg.Server.ReadTimeout.Duration != tc.read || cfg.Server.WriteTimeout.Duration != tc.write ||
+			len(cfg.Auth) != tc.secrets || cfg.Log.Level != tc.level {
+			t.Errorf("[%s] unexpected config %+v", tc.name, cfg)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+		errs []string
+	}{
+		{name: "no secrets", file: `{}`, errs: []string{"auth: no secrets"}},
+		{name: "typo in file", file: `{"auth": {"a": "b"}, "rate_limit": {}}`, errs: []string{`unknown field "rate_limit"`}},
+		{name: "bad duration", file: `{"auth": {"a": "b"}, "server": {"read_timeout": 5}}`, errs: []string{"duration must be a string"}},
+		{
+			name: "everything at once",
+			file: `{"server": {"addr": "", "idle_timeout": "0s"}, "auth": {"a": "same", "b": "same", "c": ""}, "rate_limits": {"MyApi.Create": {"rate": "fast"}}, "log": {"level": "loud"}}`,
+			errs: []string{"server.addr is empty", "server.idle_timeout must be > 0", "share a secret", `empty secret for "c"`, "rate_limits.MyApi.Create: bad rate", "log.level"},
+		},
+		{name: "bad env secrets", file: `{}`, env: map[string]string{"API_AUTH_SECRETS": "nocolon"}, errs: []string{"API_AUTH_SECRETS"}},
+		{name: "bad env timeout", file: `{"auth": {"a": "b"}}`, env: map[string]string{"API_IDLE_TIMEOUT": "later"}, errs: []string{"API_IDLE_TIMEOUT"}},
+		{name: "extra args", file: `{"auth": {"a": "b"}}`, args: []string{"api.go"}, errs: []string{"unexpected arguments"}},
+		{name: "tls key without cert", file: `{"auth": {"a": "b"}}`, env: map[string]string{"API_TLS_KEY": "server.key"}, errs: []string{"cert and key must be set together"}},
+		{name: "client ca without https", file: `{"auth": {"a": "b"}}`, args: []string{"-tls-client-ca", "ca.pem"}, errs: []string{"client_ca requires cert"}},
+		{name: "limit without annotation", file: `{"auth": {"a": "b"}, "rate_limits": {"MyApi.Profile": {"rate": "1/s"}}}`, errs: []string{`no rate_limit for "MyApi.Profile"`}},
+	}
+	for _, tc := range cases {
+		args := append([]string{"-config", writeConfig(t, tc.file)}, tc.args...)
+		_, err := loadConfig(args, func(name string) string { return tc.env[name] })
+		if err == nil {
+			t.Errorf("[%s] expected error", tc.name)
+			continue
+		}
+		for _, text := range tc.errs {
+			if !strings.Contains(err.Error(), text) {
+				t.Errorf("[%s] expected %q in error:\n%v", tc.name, text, err)
+			}
+		}
+	}
+}
+
+func TestConfigApply(t *testing.T) {
+	cfg, err := loadConfig([]string{"-config", writeConfig(t, testConfig)}, func(string) string { return "" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit := cfg.rateLimits()["MyApi.Create"]; limit.Burst != 50 || limit.Rate != 10 {
+		t.Errorf("unexpected rate limit: %+v", limit)
+	}
+
+	ts := httptest.NewServer(testHandler(t, cfg))
+	defer ts.Close()
+	cases := []struct {
+		name   string
+		auth   string
+		origin string
+		status int
+		cors   string
+	}{
+		{"secret from config", "s3cr3t", "https://admin.example.com", http.StatusOK, "https://admin.example.com"},
+		{"old constant", "100500", "", http.StatusForbidden, ""},
+		{"origin from annotation", "t0p", appOrigin, http.StatusOK, ""},
+	}
+	for i, tc := range cases {
+		login := "config_user_" + string(rune('a'+i))
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/user/create?login="+login+"_long&age=20", nil)
+		req.Header.Set("X-Auth", tc.auth)
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || resp.Header.Get("Access-Control-Allow-Origin") != tc.cors {
+			t.Errorf("[%s] unexpected response %d, cors %q", tc.name, resp.StatusCode, resp.Header.Get("Access-Control-Allow-Origin"))
+		}
+	}
+
+	// настройки сервера - только у его экземпляров, у остальных как в метке
+	other := httptest.NewServer(NewMyApi(testAuth))
+	defer other.Close()
+	req, _ := http.NewRequest(http.MethodGet, other.URL+"/user/profile?login=rvasily", nil)
+	req.Header.Set("Origin", "https://admin.example.com")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("origin from config leaked to another instance: %q", got)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const appOrigin = "https://app.example.com"
+
+func corsRequest(t *testing.T, method, url string, headers map[string]string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, nil)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestCORSPreflight(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi(testAuth))
+	defer ts.Close()
+
+	cases := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		status  int
+		origin  string
+		methods string
+	}{
+		{
+			name:    "profile accepts any method",
+			path:    ApiUserProfile,
+			headers: map[string]string{"Origin": appOrigin, "Access-Control-Request-Method": "GET"},
+			status:  http.StatusNoContent,
+			origin:  appOrigin,
+			methods: "GET, POST",
+		},
+		{
+			name:    "create is POST only",
+			path:    ApiUserCreate,
+			headers: map[string]string{"Origin": appOrigin, "Access-Control-Request-Method": "POST", "Access-Control-Request-Headers": "x-auth"},
+			status:  http.StatusNoContent,
+			origin:  appOrigin,
+			methods: "POST",
+		},
+		{
+			name:    "wrong method for create",
+			path:    ApiUserCreate,
+			headers: map[string]string{"Origin": appOrigin, "Access-Control-Request-Method": "PUT"},
+			status:  http.StatusNoContent,
+		},
+		{
+			name:    "foreign origin",
+			path:    ApiUserProfile,
+			headers: map[string]string{"Origin": "https://evil.example.com", "Access-Control-Request-Method": "GET"},
+			status:  http.StatusNoContent,
+		},
+		{
+			name:   "plain OPTIONS is still a bad method",
+			path:   ApiUserCreate,
+			status: http.StatusNotAcceptable,
+		},
+	}
+	for _, tc := range cases {
+		resp := corsRequest(t, http.MethodOptions, ts.URL+tc.path, tc.headers)
+		if resp.StatusCode != tc.status {
+			t.Errorf("[%s] expected status %d, got %d", tc.name, tc.status, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Origin"); got != tc.origin {
+			t.Errorf("[%s] expected allow origin %q, got %q", tc.name, tc.origin, got)
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Methods"); got != tc.methods {
+			t.Errorf("[%s] expected allow methods %q, got %q", tc.name, tc.methods, got)
+		}
+		if tc.origin != "" && resp.Header.Get("Access-Control-Max-Age") != "600" {
+			t.Errorf("[%s] expected max age 600, got %q", tc.name, resp.Header.Get("Access-Control-Max-Age"))
+		}
+	}
+}
+
+func TestCORSActualRequest(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi(testAuth))
+	defer ts.Close()
+
+	resp := corsRequest(t, http.MethodGet, ts.URL+ApiUserProfile+"?login=rvasily", map[string]string{"Origin": appOrigin})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != appOrigin {
+		t.Errorf("expected 200 with allow origin, got %d %v", resp.StatusCode, resp.Header)
+	}
+	if resp.Header.Get("Access-Control-Expose-Headers") != "ETag, Retry-After, X-Next-Cursor, X-Request-Id" {
+		t.Errorf("expected exposed headers, got %q", resp.Header.Get("Access-Control-Expose-Headers"))
+	}
+
+	// ошибки тоже должны дойти до браузера
+	resp = corsRequest(t, http.MethodGet, ts.URL+ApiUserProfile+"?login=nobody", map[string]string{"Origin": appOrigin})
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("Access-Control-Allow-Origin") != appOrigin {
+		t.Errorf("expected 404 with allow origin, got %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// без Origin - обычный ответ, но кешу надо знать, что он от Origin зависит
+	resp = corsRequest(t, http.MethodGet, ts.URL+ApiUserProfile+"?login=rvasily", nil)
+	if resp.Header.Get("Access-Control-Allow-Origin") != "" || resp.Header.Get("Vary") != "Origin" {
+		t.Errorf("unexpected headers without Origin: %v", resp.Header)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	ApiUserUpdate = "/user/update"
+	ApiUserDelete = "/user/delete"
+)
+
+func TestMyApiCRUD(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi(testAuth))
+	defer ts.Close()
+
+	cases := []Case{
+		Case{ // меняем только имя, статус остаётся
+			Path:   ApiUserUpdate,
+			Method: http.MethodPost,
+			Query:  "login=rvasily&full_name=Vasily",
+			Auth:   true,
+			Status: http.StatusOK,
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"id":        42,
+					"login":     "rvasily",
+					"full_name": "Vasily",
+					"status":    20,
+					"version":   2,
+				},
+			},
+		},
+		Case{ // теперь статус
+			Path:   ApiUserUpdate,
+			Method: http.MethodPost,
+			Query:  "login=rvasily&status=moderator",
+			Auth:   true,
+			Status: http.StatusOK,
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"id":        42,
+					"login":     "rvasily",
+					"full_name": "Vasily",
+					"status":    10,
+					"version":   3,
+				},
+			},
+		},
+		Case{ // изменения видны в профиле
+			Path:   ApiUserProfile,
+			Query:  "login=rvasily",
+			Status: http.StatusOK,
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"id":        42,
+					"login":     "rvasily",
+					"full_name": "Vasily",
+					"status":    10,
+					"version":   3,
+				},
+			},
+		},
+		Case{ // статус вне списка
+			Path:   ApiUserUpdate,
+			Method: http.MethodPost,
+			Query:  "login=rvasily&status=god",
+			Auth:   true,
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error":   "status must be one of [user, moderator, admin]",
+				"code":    "param_not_in_enum",
+				"details": CR{"param": "status", "enum": []string{"user", "moderator", "admin"}},
+			},
+		},
+		Case{ // нет такого пользователя
+			Path:   ApiUserUpdate,
+			Method: http.MethodPost,
+			Query:  "login=nobody&full_name=Nobody",
+			Auth:   true,
+			Status: http.StatusNotFound,
+			Result: CR{
+				"error":   "user not exist",
+				"code":    "user_not_found",
+				"details": CR{"login": "nobody"},
+			},
+		},
+		Case{ // без авторизации
+			Path:   ApiUserUpdate,
+			Method: http.MethodPost,
+			Query:  "login=rvasily&full_name=Hacker",
+			Status: http.StatusForbidden,
+			Result: CR{
+				"error": "unauthorized",
+				"code":  "unauthorized",
+			},
+		},
+		Case{ // удаление
+			Path:   ApiUserDelete,
+			Method: http.MethodPost,
+			Query:  "login=rvasily",
+			Auth:   true,
+			Status: http.StatusOK,
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"id":        42,
+					"login":     "rvasily",
+					"full_name": "Vasily",
+					"status":    10,
+					"version":   3,
+				},
+			},
+		},
+		Case{ // повторное удаление - уже нечего
+			Path:   ApiUserDelete,
+			Method: http.MethodPost,
+			Query:  "login=rvasily",
+			Auth:   true,
+			Status: http.StatusNotFound,
+			Result: CR{
+				"error":   "user not exist",
+				"code":    "user_not_found",
+				"details": CR{"login": "rvasily"},
+			},
+		},
+		Case{ // и профиля больше нет
+			Path:   ApiUserProfile,
+			Query:  "login=rvasily",
+			Status: http.StatusNotFound,
+			Result: CR{
+				"error":   "user not exist",
+				"code":    "user_not_found",
+				"details": CR{"login": "rvasily"},
+			},
+		},
+		Case{ // логин освободился
+			Path:   ApiUserCreate,
+			Method: http.MethodPost,
+			Query:  "login=rvasily_again&full_name=Again",
+			Auth:   true,
+			Status: http.StatusOK,
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"id": 43,
+				},
+			},
+		},
+		Case{ // список после всех изменений
+			Path:   "/user/list",
+			Query:  "limit=10",
+			Status: http.StatusOK,
+			Result: CR{
+				"error": "",
+				"response": []CR{
+					CR{
+						"id":        43,
+						"login":     "rvasily_again",
+						"full_name": "Again",
+						"status":    0,
+						"version":   1,
+					},
+				},
+				"next_cursor": "",
+			},
+		},
+	}
+
+	runTests(t, ts, cases)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// discardWriter - ResponseWriter без аллокаций, чтобы мерить только кодирование
+type discardWriter struct {
+	header http.Header
+	n      int
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	return len(p), nil
+}
+
+func (w *discardWriter) WriteHeader(int) {}
+
+func TestAppendJSONMatchesEncodingJSON(t *testing.T) {
+	users := []*User{
+		{ID: 42, Login: "rvasily", FullName: "Vasily Romanov", Status: statusAdmin},
+		{},
+		{ID: 1<<64 - 1, Login: `quote " back \ slash`, FullName: "<script>&amp;</script>", Status: -7},
+		{Login: "ctl \x00\x01\b\f\n\r\t\x1f", FullName: "юникод    \xff\xfe broken"},
+		nil,
+	}
+	for idx, user := range users {
+		expected, _ := json.Marshal(user)
+		if got := user.AppendJSON(nil); !bytes.Equal(got, expected) {
+			t.Errorf("[%d] AppendJSON\nGot:      %s\nExpected: %s", idx, got, expected)
+		}
+
+		var buf bytes.Buffer
+		json.NewEncoder(&buf).Encode(map[string]interface{}{"error": "", "response": user})
+		w := httptest.NewRecorder()
+		writeApiJSONResult(w, nil, user)
+		if !bytes.Equal(w.Body.Bytes(), buf.Bytes()) {
+			t.Errorf("[%d] envelope\nGot:      %s\nExpected: %s", idx, w.Body.Bytes(), buf.Bytes())
+		}
+	}
+
+	newUser := &NewUser{ID: 43}
+	expected, _ := json.Marshal(newUser)
+	if got := newUser.AppendJSON(nil); !bytes.Equal(got, expected) {
+		t.Errorf("NewUser AppendJSON\nGot:      %s\nExpected: %s", got, expected)
+	}
+}
+
+func TestWriteApiJSONResultAllocs(t *testing.T) {
+	user := &User{ID: 42, Login: "rvasily", FullName: "Vasily Romanov", Status: statusAdmin}
+	w := &discardWriter{header: http.Header{}}
+	allocs := testing.AllocsPerRun(100, func() {
+		writeApiJSONResult(w, nil, user)
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations, got %v", allocs)
+	}
+}
+
+func BenchmarkProfileEnvelope(b *testing.B) {
+	user := &User{ID: 42, Login: "rvasily", FullName: "Vasily Romanov", Status: statusAdmin}
+	w := &discardWriter{header: http.Header{}}
+
+	b.Run("map+encoding/json", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			writeApiJSON(w, nil, http.StatusOK, map[string]interface{}{
+				"error":    "",
+				"response": user,
+			})
+		}
+	})
+	b.Run("AppendJSON", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			writeApiJSONResult(w, nil, user)
+		}
+	})
+}
+
+func BenchmarkUserProfile(b *testing.B) {
+	api := NewMyApi(testAuth)
+	req := httptest.NewRequest(http.MethodGet, ApiUserProfile+"?login=rvasily", nil)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		api.ServeHTTP(&discardWriter{header: http.Header{}}, req)
+	}
+}
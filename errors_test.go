@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestApiErrorClassification(t *testing.T) {
+	notFound := ApiError{HTTPStatus: http.StatusNotFound, Err: errors.New("user not exist")}
+
+	cases := []struct {
+		Name   string
+		Err    error
+		Status int
+		Result string
+	}{
+		{"value", notFound, http.StatusNotFound, "user not exist"},
+		{"pointer", &notFound, http.StatusNotFound, "user not exist"},
+		{"wrapped value", fmt.Errorf("profile: %w", notFound), http.StatusNotFound, "profile: user not exist"},
+		{"wrapped pointer", fmt.Errorf("profile: %w", &notFound), http.StatusNotFound, "profile: user not exist"},
+		{"double wrapped", fmt.Errorf("api: %w", fmt.Errorf("profile: %w", notFound)), http.StatusNotFound, "api: profile: user not exist"},
+		{"joined", errors.Join(errors.New("first"), notFound), http.StatusNotFound, "first\nuser not exist"},
+		{"zero status", ApiError{Err: errors.New("no status")}, http.StatusInternalServerError, "no status"},
+		{"unknown", errors.New("bad user"), http.StatusInternalServerError, "bad user"},
+		{"wrapped unknown", fmt.Errorf("create: %w", errors.New("bad user")), http.StatusInternalServerError, "create: bad user"},
+	}
+
+	for _, item := range cases {
+		w := httptest.NewRecorder()
+		writeApiError(w, httptest.NewRequest("GET", "/user/profile", nil), item.Err)
+
+		if w.Code != item.Status {
+			t.Errorf("[%s] expected http status %v, got %v", item.Name, item.Status, w.Code)
+		}
+		var result map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Errorf("[%s] cant unpack json: %v", item.Name, err)
+			continue
+		}
+		if result["error"] != item.Result {
+			t.Errorf("[%s] expected error %q, got %q", item.Name, item.Result, result["error"])
+		}
+	}
+}
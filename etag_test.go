@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func etagRequest(t *testing.T, method, target string, form url.Values, headers map[string]string) *http.Response {
+	t.Helper()
+	var req *http.Request
+	if method == http.MethodPost {
+		req, _ = http.NewRequest(method, target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Auth", "100500")
+	} else {
+		req, _ = http.NewRequest(method, target+"?"+form.Encode(), nil)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestProfileETag(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi(testAuth))
+	defer ts.Close()
+	login := url.Values{"login": {"rvasily"}}
+
+	resp := etagRequest(t, http.MethodGet, ts.URL+ApiUserProfile, login, nil)
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if etag != `"42-1"` {
+		t.Fatalf("unexpected ETag %q", etag)
+	}
+
+	cases := []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{"not modified", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"not modified, weak", map[string]string{"If-None-Match": `"1-1", W/` + etag}, http.StatusNotModified},
+		{"not modified, any", map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"modified", map[string]string{"If-None-Match": `"42-0"`}, http.StatusOK},
+		{"if-match ok", map[string]string{"If-Match": etag}, http.StatusOK},
+		{"if-match weak never matches", map[string]string{"If-Match": "W/" + etag}, http.StatusPreconditionFailed},
+		{"if-match stale", map[string]string{"If-Match": `"42-0"`}, http.StatusPreconditionFailed},
+	}
+	for _, tc := range cases {
+		resp := etagRequest(t, http.MethodGet, ts.URL+ApiUserProfile, login, tc.headers)
+		var body CR
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+
+		if resp.StatusCode != tc.status {
+			t.Errorf("[%s] expected status %d, got %d", tc.name, tc.status, resp.StatusCode)
+		}
+		if resp.Header.Get("ETag") != etag {
+			t.Errorf("[%s] expected ETag %s, got %q", tc.name, etag, resp.Header.Get("ETag"))
+		}
+		if tc.status == http.StatusPreconditionFailed && body["code"] != "precondition_failed" {
+			t.Errorf("[%s] expected precondition_failed in envelope, got %v", tc.name, body)
+		}
+	}
+}
+
+// два клиента прочитали профиль, второй пишет поверх первого - получает 412
+func TestUpdateIfMatch(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi(testAuth))
+	defer ts.Close()
+
+	resp := etagRequest(t, http.MethodGet, ts.URL+ApiUserProfile, url.Values{"login": {"rvasily"}}, nil)
+	resp.Body.Close()
+	read := resp.Header.Get("ETag")
+
+	first := etagRequest(t, http.MethodPost, ts.URL+ApiUserUpdate,
+		url.Values{"login": {"rvasily"}, "full_name": {"First"}}, map[string]string{"If-Match": read})
+	first.Body.Close()
+	if first.StatusCode != http.StatusOK {
+		t.Fatalf("expected first update to pass, got %d", first.StatusCode)
+	}
+	if etag := first.Header.Get("ETag"); etag != `"42-2"` {
+		t.Errorf("expected new ETag after update, got %q", etag)
+	}
+
+	second := etagRequest(t, http.MethodPost, ts.URL+ApiUserUpdate,
+		url.Values{"login": {"rvasily"}, "full_name": {"Second"}}, map[string]string{"If-Match": read})
+	var body CR
+	json.NewDecoder(second.Body).Decode(&body)
+	second.Body.Close()
+	if second.StatusCode != http.StatusPreconditionFailed || body["code"] != "precondition_failed" {
+		t.Errorf("expected 412 precondition_failed, got %d %v", second.StatusCode, body)
+	}
+
+	deleted := etagRequest(t, http.MethodPost, ts.URL+ApiUserDelete,
+		url.Values{"login": {"rvasily"}}, map[string]string{"If-Match": read})
+	deleted.Body.Close()
+	if deleted.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("expected stale delete to fail with 412, got %d", deleted.StatusCode)
+	}
+
+	resp = etagRequest(t, http.MethodGet, ts.URL+ApiUserProfile, url.Values{"login": {"rvasily"}}, nil)
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if name := body["response"].(map[string]interface{})["full_name"]; name != "First" {
+		t.Errorf("second update must not overwrite the first, got %v", name)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"text/template"
+)
+
+// поле с логгером, куда обёртки пишут по записи на запрос
+const accessLogger = "slog.Logger"
+
+// AccessLog - выражение с логгером запросов
+func (srv *ServiceMeta) AccessLog() string {
+	return "h." + srv.AccessLogField
+}
+
+// Recorded - обёрткам нужен статус и ошибка ответа: для лога, метрик или span'а
+func (srv *ServiceMeta) Recorded() bool {
+	return srv.AccessLogField != "" || srv.Metrics || srv.TracerField != ""
+}
+
+// ErrorWriter - чем пишет ошибки обёртка: с записью статуса ответа - через
+// writeErr, который запоминает код ошибки
+func (method *MethodMeta) ErrorWriter() string {
+	if method.Service.Recorded() {
+		return "writeErr"
+	}
+	return method.Service.ErrorWriter()
+}
+
+func hasRecorder(services []*ServiceMeta) bool {
+	for _, srv := range services {
+		if srv.Recorded() {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAccessLog(services []*ServiceMeta) bool {
+	for _, srv := range services {
+		if srv.AccessLogField != "" {
+			return true
+		}
+	}
+	return false
+}
+
+var requestIDTpl = template.Must(template.New("requestIDTpl").Funcs(funcs).Parse(`
+type apiRequestIDKey struct{}
+
+// WithRequestID - id запроса в контексте, обёртки кладут туда X-Request-Id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, apiRequestIDKey{}, id)
+}
+
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(apiRequestIDKey{}).(string)
+	return id, ok && id != ""
+}
+
+// apiRequestID - X-Request-Id клиента или прокси, если он похож на id,
+// иначе новый. Длинный или с пробелами и управляющими символами не берём -
+// он попадёт в логи и заголовки ответа как есть
+func apiRequestID(r *http.Request) string {
+	id := r.Header.Get("X-Request-Id")
+	valid := id != "" && len(id) <= 128
+	for i := 0; valid && i < len(id); i++ {
+		valid = id[i] > ' ' && id[i] < 0x7f
+	}
+	if valid {
+		return id
+	}
+	var buf [16]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+// withApiRequestID отдаёт id запроса в X-Request-Id ответа и кладёт в контекст.
+// Уже выданный middleware id не меняется
+func withApiRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	id, ok := RequestIDFromContext(r.Context())
+	if !ok {
+		id = apiRequestID(r)
+		r = r.WithContext(WithRequestID(r.Context(), id))
+	}
+	w.Header().Set("X-Request-Id", id)
+	return r
+}
+`))
+
+var recorderTpl = template.Must(template.New("recorderTpl").Funcs(funcs).Parse(`
+// apiRecorder запоминает, чем закончился запрос, - для лога, метрик и span'а
+type apiRecorder struct {
+	http.ResponseWriter
+	status int
+	// err - ошибка ответа, code - её код, invalidParam - параметр, не прошедший проверку
+	err          error
+	code         string
+	invalidParam string
+	// principal - кто прошёл проверку X-Auth в обёртке
+	principal string
+}
+
+func (rec *apiRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *apiRecorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(data)
+}
+
+func (rec *apiRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// errorWriter - writeErr, который сначала запоминает ошибку, код и параметр
+func (rec *apiRecorder) errorWriter(writeErr apiErrorWriter) apiErrorWriter {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		code, details := apiErrorCode(err)
+		rec.err, rec.code = err, code
+		rec.invalidParam, _ = details["param"].(string)
+		writeErr(w, r, err)
+	}
+}
+
+// finalStatus - статус ответа. Ничего не записано - 200, как у net/http,
+// или 499, если клиент ушёл раньше
+func (rec *apiRecorder) finalStatus(r *http.Request) int {
+	switch {
+	case rec.status != 0:
+		return rec.status
+	case r.Context().Err() != nil:
+		return 499
+	}
+	return http.StatusOK
+}
+`))
+
+var accessLogTpl = template.Must(template.New("accessLogTpl").Funcs(funcs).Parse(`
+// logApiAccess вызывается через defer в обёртках структур с полем *slog.Logger:
+// одна запись на запрос. 5xx - Error, 4xx - Warn, остальное - Info.
+// nil в поле - запросы не логируются
+func logApiAccess(logger *slog.Logger, rec *apiRecorder, r *http.Request, api, endpoint string, start time.Time) {
+	if logger == nil {
+		return
+	}
+	status := rec.finalStatus(r)
+	level := slog.LevelInfo
+	switch {
+	case status >= http.StatusInternalServerError:
+		level = slog.LevelError
+	case status >= http.StatusBadRequest:
+		level = slog.LevelWarn
+	}
+
+	attrs := []slog.Attr{
+		slog.String("api", api),
+		slog.String("endpoint", endpoint),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.Int("status", status),
+		slog.Duration("duration", time.Since(start)),
+	}
+	if id, ok := RequestIDFromContext(r.Context()); ok {
+		attrs = append(attrs, slog.String("request_id", id))
+	}
+	principal := rec.principal
+	if principal == "" {
+		principal, _ = PrincipalFromContext(r.Context())
+	}
+	if principal != "" {
+		attrs = append(attrs, slog.String("principal", principal))
+	}
+	if rec.code != "" {
+		attrs = append(attrs, slog.String("code", rec.code))
+	}
+	if rec.invalidParam != "" {
+		attrs = append(attrs, slog.String("invalid_param", rec.invalidParam))
+	}
+	logger.LogAttrs(r.Context(), level, "apigen: request", attrs...)
+}
+`))
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"text/template"
+)
+
+// тип поля с секретами X-Auth для "auth": true методов
+const authSecrets = "AuthSecrets"
+
+// AuthMode - как обёртка проверяет, кто пришёл
+type AuthMode string
+
+const (
+	authHeader AuthMode = "header"
+	authMTLS   AuthMode = "mtls"
+)
+
+// UnmarshalJSON - "auth": true / false, как раньше, или "mtls"
+func (mode *AuthMode) UnmarshalJSON(data []byte) error {
+	var enabled bool
+	if err := json.Unmarshal(data, &enabled); err == nil {
+		*mode = ""
+		if enabled {
+			*mode = authHeader
+		}
+		return nil
+	}
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil || AuthMode(name) != authMTLS {
+		return fmt.Errorf("auth must be true, false or %q, got %s", authMTLS, data)
+	}
+	*mode = authMTLS
+	return nil
+}
+
+// checkAuth - секреты "auth": true методов лежат в поле типа AuthSecrets,
+// своих секретов у сгенерированного кода нет
+func checkAuth(method *MethodMeta, srv *ServiceMeta) {
+	if method.Auth == authHeader && srv.AuthField == "" {
+		log.Fatalf("%s.%s: auth declared, but %s has no %s field", method.ApiName, method.Name, method.ApiName, authSecrets)
+	}
+}
+
+// AuthPrincipal - вызов, который достаёт principal запроса, или "" без auth
+func (method *MethodMeta) AuthPrincipal() string {
+	switch method.Auth {
+	case authMTLS:
+		return "apiClientCertPrincipal(r)"
+	case authHeader:
+		return "apiAuthenticate(r, " + method.Service.Secrets() + ")"
+	}
+	return ""
+}
+
+// Secrets - выражение с секретами обёрток
+func (srv *ServiceMeta) Secrets() string {
+	return "h." + srv.AuthField
+}
+
+func hasAuthSecrets(services []*ServiceMeta) bool {
+	for _, srv := range services {
+		if srv.AuthField != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func hasMTLS(services []*ServiceMeta) bool {
+	for _, srv := range services {
+		for _, method := range srv.Methods {
+			if method.Auth == authMTLS {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var mtlsTpl = template.Must(template.New("mtlsTpl").Funcs(funcs).Parse(`
+// apiClientCertPrincipal - principal из проверенного сервером клиентского
+// сертификата: CommonName, а без него - весь Subject. Сертификат, который
+// сервер не проверил (нет ClientCAs), не считается
+func apiClientCertPrincipal(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if subject.CommonName != "" {
+		return subject.CommonName, true
+	}
+	return subject.String(), subject.String() != ""
+}
+`))
+
+var authTpl = template.Must(template.New("authTpl").Funcs(funcs).Parse(`
+// AuthSecrets - principal -> секрет, который он присылает в X-Auth. Поле этого
+// типа в структуре API нужно "auth": true методам. Пустое поле не пускает никого
+type AuthSecrets map[string]string
+
+// apiAuthenticate - principal, чей секрет пришёл в X-Auth. Сравнение за
+// постоянное время, чтобы секрет нельзя было подобрать по времени ответа
+func apiAuthenticate(r *http.Request, secrets AuthSecrets) (string, bool) {
+	got := r.Header.Get("X-Auth")
+	if got == "" {
+		return "", false
+	}
+	for principal, secret := range secrets {
+		if secret != "" && subtle.ConstantTimeCompare([]byte(got), []byte(secret)) == 1 {
+			return principal, true
+		}
+	}
+	return "", false
+}
+`))
@@ -3,24 +3,49 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"go/ast"
+	"go/format"
 	"go/parser"
 	"go/token"
 	"log"
 	"os"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
 	"unicode"
 )
 
+const (
+	apigenPrefix    = "// apigen:api "
+	apiValidatorTag = "apivalidator"
+
+	// тип поля структуры API, из которого берутся middleware по имени
+	middlewareRegistry = "MiddlewareRegistry"
+	// тип поля, где хранятся обёртки, собранные Handler()
+	apiRoutes = "ApiRoutes"
+	// поле с логгером, куда пишутся паники обёрток
+	panicLogger = "log.Logger"
+
+	modeSwitch = "switch"
+	modeMux    = "mux"
+
+	formatEnvelope = "envelope"
+	formatProblem  = "problem"
+)
+
 func ToCamelCase(stringSlice []string) string {
 
 	var pathSlice []string
 
 	for _, route := range stringSlice {
-
+		if route == "" {
+			continue
+		}
 		runes := []rune(route)
 		runes[0] = unicode.ToUpper(runes[0])
 		pathSlice = append(pathSlice, string(runes))
@@ -28,58 +53,77 @@ func ToCamelCase(stringSlice []string) string {
 	return strings.Join(pathSlice, "")
 }
 
+// APIMeta - то, что лежит в json после метки apigen:api
 type APIMeta struct {
-	URL    string `json:"url"`
-	Auth   bool   `json:"auth"`
-	Method string `json:"method"`
+	URL string `json:"url"`
+	// Auth - true (секрет в X-Auth) или "mtls" (клиентский сертификат)
+	Auth   AuthMode `json:"auth"`
+	Method string   `json:"method"`
 
-	Entity string
-	Action string
+	Middleware []string `json:"middleware"`
+	// ETag - ETag из res.ETag(), If-None-Match/If-Match для GET, If-Match
+	// для изменений передаётся методу в контексте (checkApiIfMatch)
+	ETag bool `json:"etag"`
+	// Idempotent - повтор с тем же Idempotency-Key получает первый ответ
+	Idempotent bool `json:"idempotent"`
+	// RateLimit - "10/s", "100/m", "1000/h" на клиента, Burst - сколько подряд
+	RateLimit string `json:"rate_limit"`
+	Burst     int    `json:"burst"`
+	// Timeout - дедлайн контекста метода, "2s", "500ms"
+	Timeout string `json:"timeout"`
+	// MaxBody - предел тела запроса, "64KB"; Strict - неизвестный параметр - 400
+	MaxBody string `json:"max_body"`
+	Strict  bool   `json:"strict"`
+	// CORS - заменяет CORS из метки структуры
+	CORS *CORSConfig `json:"cors"`
 }
 
-func OpenForm(out *os.File, funcName, structName string) {
-	template := template.Must(template.New("formTpl").Parse(`
-func {{.FuncName}}(r *http.Request) ({{.StructName}}, error) {
-    var data {{.StructName}}
-	`))
-	template.Execute(out, tpl{FuncName: funcName, StructName: structName})
+// ServiceConfig - json после метки apigen:api над самой структурой API
+type ServiceConfig struct {
+	Middleware []string `json:"middleware"`
 
-}
+	// Format - как отдавать ошибки: envelope ({"error": ...}) или problem (RFC 7807)
+	Format string `json:"format"`
+	// ProblemType - префикс для "type" problem-документа, к нему дописывается код ошибки
+	ProblemType string `json:"problem_type"`
 
-func CloseForm(out *os.File) {
-	template := template.Must(template.New("formTpl").Parse(`
-	return data, nil
-}
-	`))
-	template.Execute(out, tpl{})
+	// Encoders - форматы ответа, из которых выбирается по Accept: json, msgpack, binpack
+	Encoders []string `json:"encoders"`
 
-}
+	// MaxBody и Strict - значения по-умолчанию для всех методов структуры
+	MaxBody string `json:"max_body"`
+	Strict  bool   `json:"strict"`
+
+	// CORS - для всех методов структуры, у которых нет своего
+	CORS *CORSConfig `json:"cors"`
+
+	// Metrics - считать запросы методов структуры для MetricsHandler
+	Metrics bool `json:"metrics"`
 
-type ApiError struct {
-	HTTPStatus int
-	Err        error
+	// Health - префикс служебных healthz, readyz и version, например "/user/"
+	Health string `json:"health"`
 }
 
-func FillJobTemplate(funcName, body string) string {
-	var buf bytes.Buffer
-	jobTemplate.Execute(&buf, tpl{FuncName: funcName, Body: body})
-	return buf.String()
+// Wildcards возвращает имена {wildcard} из URL в порядке следования
+func (meta APIMeta) Wildcards() []string {
+	var names []string
+	for _, part := range strings.Split(meta.URL, "/") {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			name := strings.TrimSuffix(part[1:len(part)-1], "...")
+			if name != "$" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
 }
 
-func writeServeHTTP(out *os.File, currentApiName string, metaSlice []APIMeta) {
-	var cases string
-	for _, meta := range metaSlice {
-		var buf bytes.Buffer
-		caseTpl.Execute(&buf, tpl{
-			Body:     strconv.Quote(meta.URL),
-			FuncName: ToCamelCase([]string{meta.Entity, meta.Action}),
-		})
-		cases += string(buf.String())
+// Pattern - шаблон для http.ServeMux из go 1.22: "POST /user/create"
+func (meta APIMeta) Pattern() string {
+	if meta.Method == "" {
+		return meta.URL
 	}
-	serveTpl.Execute(out, tpl{
-		ApiName: currentApiName,
-		Body:    cases,
-	})
+	return meta.Method + " " + meta.URL
 }
 
 type FieldMeta struct {
@@ -90,380 +134,1486 @@ type FieldMeta struct {
 	// * `min` - >= X для типа `int`, для строк `len(str)` >=
 	// * `max` - <= X для типа `int`
 	Name      string
+	Type      string
 	Required  bool
 	ParamName string
 	Enum      []string
 	Default   string
 	Min       int
 	Max       int
+	HasMin    bool
+	HasMax    bool
+
+	// FromPath - значение берётся из r.PathValue, а не из query/body
+	FromPath bool
 }
 
-func (field *FieldMeta) RequiredCheck(out *os.File) {
-	if !field.Required {
-		return
+func (field FieldMeta) IsInt() bool {
+	return field.Type == "int"
+}
+
+// Value - выражение, с которым сравниваются min/max
+func (field FieldMeta) Value() string {
+	if field.IsInt() {
+		return "data." + field.Name
+	}
+	return "len(data." + field.Name + ")"
+}
+
+// Subject - начало текста ошибки min/max: "age" или "login len"
+func (field FieldMeta) Subject() string {
+	if field.IsInt() {
+		return field.ParamName
 	}
-	template := template.Must(template.New("requiredFieldTpl").Parse(`
-	// required
-	data.{{.FieldName}} = r.URL.Query().Get("{{.ParamName}}")
-	if data.{{.FieldName}} == "" {
-		return data, &ApiError{
-			HTTPStatus: http.StatusBadRequest,
-			Err: errors.New("{{.ParamName}} must me not empty"),
+	return field.ParamName + " len"
+}
+
+// Details - литерал map для ApiError.Details ошибки правила rule
+func (field FieldMeta) Details(rule string) string {
+	details := []string{`"param": ` + strconv.Quote(field.ParamName)}
+	switch rule {
+	case "enum":
+		var enum []string
+		for _, value := range field.Enum {
+			enum = append(enum, strconv.Quote(value))
 		}
+		details = append(details, `"enum": []string{`+strings.Join(enum, ", ")+`}`)
+	case "min":
+		details = append(details, `"min": `+strconv.Itoa(field.Min))
+	case "max":
+		details = append(details, `"max": `+strconv.Itoa(field.Max))
 	}
-	`))
-	template.Execute(out, tpl{
-		FieldName: field.Name,
-		ParamName: strings.ToLower(field.ParamName),
-	})
+	return "map[string]interface{}{" + strings.Join(details, ", ") + "}"
 }
 
-func (field *FieldMeta) EnumCheck(out *os.File) {
-	if len(field.Enum) == 0 {
-		return
+func (field FieldMeta) EnumText() string {
+	return strings.Join(field.Enum, ", ")
+}
+
+func parseFieldMeta(field *ast.Field) FieldMeta {
+	fieldName := field.Names[0].Name
+	fieldMeta := FieldMeta{
+		Name:      fieldName,
+		ParamName: strings.ToLower(fieldName),
 	}
-	template := template.Must(template.New("enumFieldTpl").Parse(`
-	// enum
-	enums := []string{"{{.Body}}"}
-	data.{{.FieldName}} = r.URL.Query().Get("{{.ParamName}}")
-	if !slices.Contains(enums, data.{{.FieldName}}) {
-		return data, &ApiError{
-			HTTPStatus: http.StatusBadRequest,
-			Err: errors.New("{{.ParamName}} must be one of [{{.Body}}]"),
-		}
-	}
-	`))
-	template.Execute(out, tpl{
-		FieldName: field.Name,
-		ParamName: strings.ToLower(field.ParamName),
-		Body:      strings.Join(field.Enum, ", "),
-	})
+
+	ident, ok := field.Type.(*ast.Ident)
+	if !ok || (ident.Name != "int" && ident.Name != "string") {
+		log.Fatalf("field %s: unsupported type %T %v", fieldName, field.Type, field.Type)
+	}
+	fieldMeta.Type = ident.Name
+
+	if field.Tag == nil {
+		return fieldMeta
+	}
+	tag, _ := strconv.Unquote(field.Tag.Value)
+	rules, ok := reflect.StructTag(tag).Lookup(apiValidatorTag)
+	if !ok {
+		return fieldMeta
+	}
+
+	for _, rule := range strings.Split(rules, ",") {
+		key, value, _ := strings.Cut(rule, "=")
+		switch key {
+		case "required":
+			fieldMeta.Required = true
+		case "paramname":
+			fieldMeta.ParamName = value
+		case "enum":
+			fieldMeta.Enum = strings.Split(value, "|")
+		case "default":
+			fieldMeta.Default = value
+		case "min":
+			fieldMeta.Min = mustAtoi(fieldName, rule, value)
+			fieldMeta.HasMin = true
+		case "max":
+			fieldMeta.Max = mustAtoi(fieldName, rule, value)
+			fieldMeta.HasMax = true
+		default:
+			log.Fatalf("field %s: unknown %s rule %q", fieldName, apiValidatorTag, rule)
+		}
+	}
+	return fieldMeta
 }
 
-func (field *FieldMeta) DefaultCheck(out *os.File) {
-	if field.Default == "" {
-		return
+func mustAtoi(fieldName, rule, value string) int {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("field %s: bad %s rule %q: %v", fieldName, apiValidatorTag, rule, err)
 	}
-	template := template.Must(template.New("defaultFieldTpl").Parse(`
-	// default
-	data.{{.FieldName}} = r.URL.Query().Get("{{.ParamName}}")
-	if data.{{.FieldName}} == "" {
-		data.{{.FieldName}} = "{{.Body}}"
-	}
-	`))
-	template.Execute(out, tpl{
-		FieldName: field.Name,
-		ParamName: strings.ToLower(field.ParamName),
-		Body:      field.Default,
-	})
+	return n
 }
 
-func (field *FieldMeta) MinMaxCheck(out *os.File, op string, limit int) {
-	if limit == 0 {
-		return
+// MethodMeta - метод структуры, помеченный apigen:api
+type MethodMeta struct {
+	APIMeta
+
+	Service     *ServiceMeta
+	ApiName     string
+	Name        string
+	HandlerName string
+	ParamsName  string
+	ResultName  string
+	Fields      []FieldMeta
+
+	// FastJSON - у результата есть сгенерированный AppendJSON
+	FastJSON bool
+
+	// ResultType - тип результата как в исходнике: *User, []*User, <-chan *User
+	ResultType string
+	// List - метод возвращает слайс или канал, ItemType - тип элемента
+	List     bool
+	Chan     bool
+	ItemType string
+	// Cursor - вторым результатом идёт next_cursor для следующей страницы
+	Cursor bool
+
+	// Rate - RateLimit в запросах в секунду
+	Rate float64
+	// TimeoutDuration - разобранный Timeout
+	TimeoutDuration time.Duration
+	// MaxBodyBytes - разобранный MaxBody
+	MaxBodyBytes int64
+}
+
+// ServiceMeta - структура, для которой генерируется ServeHTTP
+type ServiceMeta struct {
+	ServiceConfig
+
+	Name    string
+	Methods []*MethodMeta
+
+	// RegistryField - поле типа MiddlewareRegistry, если оно есть
+	RegistryField string
+	// RoutesField - поле типа ApiRoutes, если оно есть
+	RoutesField string
+	// Built - обёртки собираются один раз в Handler(): mux или middleware
+	Built bool
+	// LoggerField - поле типа *log.Logger, если оно есть
+	LoggerField string
+	// IdempotencyField - поле типа IdempotencyStore, если оно есть
+	IdempotencyField string
+	// LimiterField - поле типа RateLimiter, если оно есть
+	LimiterField string
+	// LimitsField - поле типа RateLimits, если оно есть
+	LimitsField string
+	// OriginsField - поле типа CORSOrigins, если оно есть
+	OriginsField string
+	// AccessLogField - поле типа *slog.Logger, если оно есть
+	AccessLogField string
+	// TracerField - поле типа Tracer, если оно есть
+	TracerField string
+	// AuthField - поле типа AuthSecrets, если оно есть
+	AuthField string
+
+	// HasReady - у структуры есть метод Ready(ctx) error для /readyz
+	HasReady bool
+	// AnnotationsHash - sha256 меток apigen:api структуры для /version
+	AnnotationsHash string
+}
+
+// ErrorWriter - функция, которой обёртки этой структуры пишут ошибки
+func (srv *ServiceMeta) ErrorWriter() string {
+	if srv.Format == formatProblem {
+		return "write" + srv.Name + "Problem"
+	}
+	if srv.Negotiate() {
+		return "write" + srv.Name + "Error"
+	}
+	return "writeApiError"
+}
+
+// ResponseWriter - функция, которой обёртки этой структуры пишут ответ
+func (srv *ServiceMeta) ResponseWriter() string {
+	if srv.Negotiate() {
+		return "write" + srv.Name + "Response"
+	}
+	return "writeApiJSON"
+}
+
+// Logger - выражение с логгером для паник
+func (srv *ServiceMeta) Logger() string {
+	if srv.LoggerField == "" {
+		return "nil"
+	}
+	return "h." + srv.LoggerField
+}
+
+// Wrap - выражение, оборачивающее handler в middleware names
+func (srv *ServiceMeta) Wrap(handler string, names []string) string {
+	if len(names) == 0 {
+		return handler
+	}
+	args := []string{handler}
+	for _, name := range names {
+		args = append(args, strconv.Quote(name))
+	}
+	return "chain.Wrap(" + strings.Join(args, ", ") + ")"
+}
+
+// HasMiddleware - у структуры или её методов есть middleware
+func (srv *ServiceMeta) HasMiddleware() bool {
+	if len(srv.Middleware) > 0 {
+		return true
 	}
-	template := template.Must(template.New("minMaxFieldTpl").Parse(`
-	// min/max
-	data.{{.FieldName}} = r.URL.Query().Get("{{.ParamName}}")
-	if data.{{.FieldName}} != "" && len(data.{{.FieldName}}) {{.Body}} {{.IntValue}} {
-	    return data, &ApiError{
-			HTTPStatus: http.StatusBadRequest,
-			Err: 		errors.New()"{{.ParamName}} must be {{.Body}}= {{.IntValue}}"),
+	for _, method := range srv.Methods {
+		if len(method.Middleware) > 0 {
+			return true
 		}
 	}
-	`))
+	return false
+}
 
-	msg := map[string]string{">": "<=", "<": ">="}[op]
+// RoutesVar - выражение с полем ApiRoutes
+func (srv *ServiceMeta) RoutesVar() string {
+	return "h." + srv.RoutesField
+}
 
-	template.Execute(out, tpl{
-		FieldName:   field.Name,
-		ParamName:   strings.ToLower(field.ParamName),
-		IntValue:    limit,
-		StringValue: msg,
-		Body:        op,
-	})
+// WrapService оборачивает handler в middleware уровня API
+func (srv *ServiceMeta) WrapService(handler string) string {
+	return srv.Wrap(handler, srv.Middleware)
+}
+
+// Handler - обёртка метода вместе с его middleware
+func (method *MethodMeta) Handler() string {
+	return method.Service.Wrap("http.HandlerFunc(h."+method.HandlerName+")", method.Middleware)
+}
+
+// MuxHandler - в режиме mux middleware уровня API навешиваются на каждый маршрут
+func (method *MethodMeta) MuxHandler() string {
+	return method.Service.WrapService(method.Handler())
+}
+
+// Route - все методы, висящие на одном URL (нужно для 405 в режиме mux).
+// Any - на URL есть метод без "method", остальные HTTP-методы уходят ему
+type Route struct {
+	URL     string
+	Methods []string
+	Any     bool
+}
+
+func (srv *ServiceMeta) Routes() []Route {
+	var routes []Route
+	index := map[string]int{}
+	for _, endpoint := range srv.Endpoints() {
+		if endpoint.Any() != nil && len(endpoint.Methods) == 1 {
+			continue
+		}
+		index[endpoint.URL] = len(routes)
+		routes = append(routes, Route{URL: endpoint.URL, Any: endpoint.Any() != nil})
+	}
+	for _, method := range srv.Methods {
+		if idx, ok := index[method.URL]; ok && method.Method != "" {
+			routes[idx].Methods = append(routes[idx].Methods, method.Method)
+		}
+	}
+	return routes
+}
+
+// Endpoint - методы структуры на одном URL: в режиме switch это один case
+type Endpoint struct {
+	URL     string
+	Methods []*MethodMeta
+}
+
+// Endpoints - методы, сгруппированные по URL в порядке объявления
+func (srv *ServiceMeta) Endpoints() []Endpoint {
+	var endpoints []Endpoint
+	index := map[string]int{}
+	for _, method := range srv.Methods {
+		idx, ok := index[method.URL]
+		if !ok {
+			idx = len(endpoints)
+			index[method.URL] = idx
+			endpoints = append(endpoints, Endpoint{URL: method.URL})
+		}
+		endpoints[idx].Methods = append(endpoints[idx].Methods, method)
+	}
+	return endpoints
+}
+
+// Shared - на URL несколько методов, выбираем по r.Method
+func (endpoint Endpoint) Shared() bool {
+	return len(endpoint.Methods) > 1
+}
+
+// Any - метод без "method" на этом URL, nil - такого нет
+func (endpoint Endpoint) Any() *MethodMeta {
+	for _, method := range endpoint.Methods {
+		if method.Method == "" {
+			return method
+		}
+	}
+	return nil
+}
+
+// Preflight - на URL нет OPTIONS и метода без "method", а CORS есть: OPTIONS
+// отвечает apiPreflight по настройкам запрошенного метода
+func (endpoint Endpoint) Preflight() bool {
+	hasCORS := false
+	for _, method := range endpoint.Methods {
+		if method.Method == "" || method.Method == "OPTIONS" {
+			return false
+		}
+		hasCORS = hasCORS || method.CORS != nil
+	}
+	return hasCORS
+}
+
+// hasSharedURL - в режиме switch есть URL с несколькими методами: нужны
+// apiMethodNotAllowed и apiPreflight
+func hasSharedURL(services []*ServiceMeta) bool {
+	for _, srv := range services {
+		for _, endpoint := range srv.Endpoints() {
+			if endpoint.Shared() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SharedURL - см. hasSharedURL
+func (t tpl) SharedURL() bool {
+	return hasSharedURL(t.Services)
+}
+
+func (route Route) Allow() string {
+	return strings.Join(route.Methods, ", ")
+}
+
+// AllowFor - Allow маршрута с этим URL
+func (srv *ServiceMeta) AllowFor(url string) string {
+	for _, route := range srv.Routes() {
+		if route.URL == url {
+			return route.Allow()
+		}
+	}
+	return ""
+}
+
+func handlerName(url string) string {
+	var parts []string
+	for _, part := range strings.Split(url, "/") {
+		if strings.HasPrefix(part, "{") {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	return ToCamelCase(parts)
+}
+
+// parseAnnotation разбирает json после метки apigen:api в meta. Неизвестное
+// поле - ошибка: опечатка в "auth" или "rate_limit" молча выключила бы проверку
+func parseAnnotation(doc *ast.CommentGroup, meta interface{}) bool {
+	if doc == nil {
+		return false
+	}
+	for _, comment := range doc.List {
+		if !strings.HasPrefix(comment.Text, apigenPrefix) {
+			continue
+		}
+		dec := json.NewDecoder(strings.NewReader(strings.TrimPrefix(comment.Text, apigenPrefix)))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(meta)
+		if err == nil && dec.More() {
+			err = fmt.Errorf("unexpected data after json")
+		}
+		if err != nil {
+			log.Fatalf("bad apigen:api json %q: %v", comment.Text, err)
+		}
+		return true
+	}
+	return false
+}
+
+// fieldOfType ищет поле структуры с типом typ (в том числе встроенное)
+func fieldOfType(st *ast.StructType, typ string) string {
+	if st == nil {
+		return ""
+	}
+	for _, field := range st.Fields.List {
+		if typeName(field.Type) != typ {
+			continue
+		}
+		if len(field.Names) == 0 {
+			return typ[strings.LastIndex(typ, ".")+1:]
+		}
+		return field.Names[0].Name
+	}
+	return ""
+}
+
+func typeName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		return t.Name
+	case *ast.StarExpr:
+		return typeName(t.X)
+	case *ast.SelectorExpr:
+		return typeName(t.X) + "." + t.Sel.Name
+	}
+	return ""
 }
 
-func (field *FieldMeta) MinCheck(out *os.File) {
-	field.MinMaxCheck(out, "<", field.Min)
+// ErrorMeta - какие поля объявлены у ApiError в разбираемом файле.
+// Code и Details у сгенерированных ошибок заполняются, только если они есть
+type ErrorMeta struct {
+	HasCode    bool
+	HasDetails bool
 }
 
-func (field *FieldMeta) MaxCheck(out *os.File) {
-	field.MinMaxCheck(out, ">", field.Max)
+func newErrorMeta(st *ast.StructType) ErrorMeta {
+	var meta ErrorMeta
+	if st == nil {
+		return meta
+	}
+	for _, field := range st.Fields.List {
+		for _, name := range field.Names {
+			meta.HasCode = meta.HasCode || name.Name == "Code"
+			meta.HasDetails = meta.HasDetails || name.Name == "Details"
+		}
+	}
+	return meta
+}
+
+// New - литерал ApiError для сгенерированного кода
+func (meta ErrorMeta) New(status, message, code, details string) string {
+	parts := []string{"HTTPStatus: " + status, "Err: errors.New(" + strconv.Quote(message) + ")"}
+	if meta.HasCode && code != "" {
+		parts = append(parts, "Code: "+strconv.Quote(code))
+	}
+	if meta.HasDetails && details != "" {
+		parts = append(parts, "Details: "+details)
+	}
+	return "ApiError{" + strings.Join(parts, ", ") + "}"
+}
+
+// collectStructs собирает все структуры файла и метки apigen:api над ними
+// поверх api - значений из -defaults
+func collectStructs(node *ast.File, api ServiceConfig) (map[string]*ast.StructType, map[string]ServiceConfig) {
+	structs := map[string]*ast.StructType{}
+	configs := map[string]ServiceConfig{}
+	for _, f := range node.Decls {
+		g, ok := f.(*ast.GenDecl)
+		if !ok {
+			continue
+		}
+		for _, spec := range g.Specs {
+			currType, ok := spec.(*ast.TypeSpec)
+			if !ok {
+				continue
+			}
+			currStruct, ok := currType.Type.(*ast.StructType)
+			if !ok {
+				continue
+			}
+			structs[currType.Name.Name] = currStruct
+
+			config := api
+			// "cors" из метки заменяет общий целиком, а не дописывается в него
+			config.CORS = nil
+			if parseAnnotation(currType.Doc, &config) || (len(g.Specs) == 1 && parseAnnotation(g.Doc, &config)) {
+				if config.Format != "" && config.Format != formatEnvelope && config.Format != formatProblem {
+					log.Fatalf("%s: unknown format %q", currType.Name.Name, config.Format)
+				}
+				config.Encoders = checkEncoders(currType.Name.Name, config.Encoders)
+			}
+			if config.CORS == nil {
+				config.CORS = api.CORS
+			}
+			configs[currType.Name.Name] = config
+		}
+	}
+	return structs, configs
+}
+
+// collect - первый проход: собираем помеченные методы по структурам API
+func collect(node *ast.File, mode string, structs map[string]*ast.StructType, configs map[string]ServiceConfig) []*ServiceMeta {
+
+	var services []*ServiceMeta
+	serviceByName := map[string]*ServiceMeta{}
+	for _, f := range node.Decls {
+		g, ok := f.(*ast.FuncDecl)
+		if !ok || g.Recv == nil {
+			continue
+		}
+		var meta APIMeta
+		if !parseAnnotation(g.Doc, &meta) {
+			fmt.Printf("SKIP %s не имеет метки apigen:api\n", g.Name.Name)
+			continue
+		}
+		if len(g.Type.Params.List) != 2 {
+			log.Fatalf("%s: expected (ctx, params) arguments", g.Name.Name)
+		}
+
+		apiName := typeName(g.Recv.List[0].Type)
+		paramsName := typeName(g.Type.Params.List[1].Type)
+		paramsStruct, ok := structs[paramsName]
+		if !ok {
+			log.Fatalf("%s.%s: params struct %s not found", apiName, g.Name.Name, paramsName)
+		}
+
+		wildcards := meta.Wildcards()
+		if len(wildcards) > 0 && mode != modeMux {
+			log.Fatalf("%s.%s: path wildcards in %s require -mode=%s", apiName, g.Name.Name, meta.URL, modeMux)
+		}
+
+		srv, ok := serviceByName[apiName]
+		if !ok {
+			srv = &ServiceMeta{
+				ServiceConfig:    configs[apiName],
+				Name:             apiName,
+				RegistryField:    fieldOfType(structs[apiName], middlewareRegistry),
+				RoutesField:      fieldOfType(structs[apiName], apiRoutes),
+				LoggerField:      fieldOfType(structs[apiName], panicLogger),
+				IdempotencyField: fieldOfType(structs[apiName], idempotencyStore),
+				LimiterField:     fieldOfType(structs[apiName], rateLimiter),
+				LimitsField:      fieldOfType(structs[apiName], rateLimits),
+				OriginsField:     fieldOfType(structs[apiName], corsOrigins),
+				AccessLogField:   fieldOfType(structs[apiName], accessLogger),
+				TracerField:      fieldOfType(structs[apiName], tracer),
+				AuthField:        fieldOfType(structs[apiName], authSecrets),
+			}
+			serviceByName[apiName] = srv
+			services = append(services, srv)
+		}
+
+		method := &MethodMeta{
+			APIMeta:     meta,
+			Service:     srv,
+			ApiName:     apiName,
+			Name:        g.Name.Name,
+			HandlerName: handlerName(meta.URL),
+			ParamsName:  paramsName,
+		}
+		if method.MaxBody == "" {
+			method.MaxBody = srv.MaxBody
+		}
+		method.Strict = method.Strict || srv.Strict
+		resultMeta(method, g.Type.Results)
+		for _, field := range paramsStruct.Fields.List {
+			fieldMeta := parseFieldMeta(field)
+			for _, name := range wildcards {
+				fieldMeta.FromPath = fieldMeta.FromPath || name == fieldMeta.ParamName
+			}
+			method.Fields = append(method.Fields, fieldMeta)
+		}
+		checkCursor(method)
+		checkETag(method)
+		checkIdempotent(method, srv)
+		checkAuth(method, srv)
+		parseRateLimit(method)
+		checkRateLimit(method, srv)
+		parseTimeout(method)
+		parseMaxBody(method)
+		checkCORS(method, srv)
+
+		if (len(meta.Middleware) > 0 || len(srv.Middleware) > 0) && srv.RegistryField == "" {
+			log.Fatalf("%s.%s: middleware declared, but %s has no %s field", apiName, g.Name.Name, apiName, middlewareRegistry)
+		}
+		fmt.Println("Создаем хэндлер для:", apiName, g.Name.Name, meta.Pattern())
+		srv.Methods = append(srv.Methods, method)
+	}
+
+	// на одном URL может висеть несколько методов (GET и PUT /user/{login}) -
+	// тогда к имени обёртки добавляем имя метода структуры. Если же имя
+	// обёртки совпало с самим методом (url /ping у метода Ping) - добавляем handle
+	for _, srv := range services {
+		for _, endpoint := range srv.Endpoints() {
+			methods := map[string]string{}
+			for _, method := range endpoint.Methods {
+				if other, ok := methods[method.Method]; ok {
+					log.Fatalf("%s.%s: %s already handles %s", srv.Name, method.Name, other, method.Pattern())
+				}
+				methods[method.Method] = method.Name
+			}
+		}
+		seen := map[string]int{}
+		for _, method := range srv.Methods {
+			seen[method.HandlerName]++
+		}
+		for _, method := range srv.Methods {
+			if seen[method.HandlerName] > 1 {
+				method.HandlerName += method.Name
+			}
+		}
+		for _, method := range srv.Methods {
+			for _, other := range srv.Methods {
+				if method.HandlerName == other.Name {
+					method.HandlerName = "handle" + method.HandlerName
+				}
+			}
+		}
+		checkHealth(node, srv)
+
+		// mux и middleware собираются один раз и хранятся в самой структуре,
+		// чтобы две структуры с разными MiddlewareRegistry не делили обёртки
+		srv.Built = mode == modeMux || srv.HasMiddleware()
+		if srv.Built && srv.RoutesField == "" {
+			log.Fatalf("%s: -mode=mux and middleware need a field of type %s to keep the built handler", srv.Name, apiRoutes)
+		}
+	}
+	return services
 }
 
 type tpl struct {
-	ApiName     string
-	FuncName    string
-	StructName  string
-	FieldName   string
-	ParamName   string
-	Body        string
-	IntValue    int
-	StringValue string
+	Mode     string
+	Services []*ServiceMeta
+	Errors   ErrorMeta
+	Problem  bool
+	Codecs   map[string]bool
+	Service  *ServiceMeta
+	Method   *MethodMeta
+}
+
+func (t tpl) with(srv *ServiceMeta, method *MethodMeta) tpl {
+	t.Service = srv
+	t.Method = method
+	return t
 }
 
 var (
-	importTpl = template.Must(template.New("importTpl").Parse(`
-import (
-	{{.Body}}
-)
-	`))
-	serveTpl = template.Must(template.New("serveTpl").Parse(`
-func (h *{{.ApiName}}) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-    switch r.URL.Path {
-    {{.Body}}
-    default:
-		resp := map[string]interface{}{
-			"error": "unknown method",
-		}
-        w.WriteHeader(http.StatusNotFound)
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(resp)
+	funcs = template.FuncMap{
+		"quote": strconv.Quote,
+	}
+
+	helpersTpl = template.Must(template.New("helpersTpl").Funcs(funcs).Parse(`
+// apiResponseWriter - то, чем обёртки пишут конверт: writeApiJSON или выбор формата по Accept
+type apiResponseWriter func(w http.ResponseWriter, r *http.Request, status int, resp map[string]interface{})
+
+func writeApiJSON(w http.ResponseWriter, r *http.Request, status int, resp map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// recoverApiPanic вызывается через defer в каждой обёртке: паника метода
+// превращается в 500 с json-ошибкой, а стек уходит в logger
+func recoverApiPanic(w http.ResponseWriter, r *http.Request, logger *log.Logger, writeErr apiErrorWriter) {
+	rec := recover()
+	if rec == nil {
 		return
-    }
+	}
+	if rec == http.ErrAbortHandler {
+		panic(rec)
+	}
+	if logger == nil {
+		logger = log.Default()
+	}
+	logger.Printf("apigen: panic serving %s %s: %v\n%s", r.Method, r.URL.Path, rec, debug.Stack())
+	writeErr(w, r, {{.Errors.New "http.StatusInternalServerError" "internal server error" "internal_error" ""}})
 }
-	`))
-	caseTpl = template.Must(template.New("caseTpl").Parse(`
-	case {{.Body}}:
-		h.{{.FuncName}}(w, r)
-	`))
-	methodTpl = template.Must(template.New("methodTpl").Parse(`
-func (h *{{.ApiName}}) {{.FuncName}}(w http.ResponseWriter, r *http.Request){
-{{.Body}}
+
+// writeApiMethodError - ошибка, которую вернул метод API. Истёкший дедлайн -
+// 504, а если клиент ушёл сам - отвечать некому, только 499 в лог, как у nginx
+func writeApiMethodError(w http.ResponseWriter, r *http.Request, err error, logger *log.Logger, writeErr apiErrorWriter) {
+	if errors.Is(r.Context().Err(), context.Canceled) {
+		if logger == nil {
+			logger = log.Default()
+		}
+		logger.Printf("apigen: 499 client closed request %s %s: %v", r.Method, r.URL.Path, err)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = {{.Errors.New "http.StatusGatewayTimeout" "timeout" "timeout" ""}}
+	}
+	writeErr(w, r, err)
 }
-`))
-	jobTemplate = template.Must(template.New("jobTpl").Parse(`
+
+func apiNotFound(writeErr apiErrorWriter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeErr(w, r, {{.Errors.New "http.StatusNotFound" "unknown method" "unknown_method" ""}})
+	})
+}
+{{if or (eq .Mode "mux") .SharedURL}}
+func apiMethodNotAllowed(allow string, writeErr apiErrorWriter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allow)
+		writeErr(w, r, {{.Errors.New "http.StatusMethodNotAllowed" "bad method" "bad_method" ""}})
+	})
+}
+{{end}}
+// apiErrorStatus достаёт HTTPStatus из ApiError или *ApiError, в том числе
+// обёрнутых через fmt.Errorf("%w"). Всё остальное - неизвестная ошибка, 500
+func apiErrorStatus(err error) int {
+	var apiErr ApiError
+	var apiErrPtr *ApiError
+	status := 0
+	switch {
+	case errors.As(err, &apiErr):
+		status = apiErr.HTTPStatus
+	case errors.As(err, &apiErrPtr) && apiErrPtr != nil:
+		status = apiErrPtr.HTTPStatus
+	}
+	if status == 0 {
+		status = http.StatusInternalServerError
+	}
+	return status
+}
+
+// apiErrorWriter - то, чем обёртки пишут ошибки: writeApiError или problem+json
+type apiErrorWriter func(w http.ResponseWriter, r *http.Request, err error)
+
+// apiErrorCode - код и подробности из ошибок с методами ErrorCode() / ErrorDetails()
+func apiErrorCode(err error) (string, map[string]interface{}) {
+	var code string
+	var details map[string]interface{}
+	var coded interface{ ErrorCode() string }
+	if errors.As(err, &coded) {
+		code = coded.ErrorCode()
+	}
+	var detailed interface {
+		ErrorDetails() map[string]interface{}
+	}
+	if errors.As(err, &detailed) {
+		details = detailed.ErrorDetails()
+	}
+	return code, details
+}
+
+// apiErrorEnvelope - конверт с ошибкой: "error" - текст для людей,
+// "code" и "details" - если ошибка умеет ErrorCode() / ErrorDetails()
+func apiErrorEnvelope(err error) map[string]interface{} {
 	resp := map[string]interface{}{
-		"error": "unknown method",
+		"error": err.Error(),
 	}
-	in, err := {{.Body}}(r)
-	if err != nil {
-		resp["error"] = err.Error()
-		if apiErr, ok := err.(ApiError); ok {
-			w.WriteHeader(apiErr.HTTPStatus)
-		} else {
-			resp["error"] = err.Error()
-			w.WriteHeader(http.StatusBadRequest)
+	code, details := apiErrorCode(err)
+	if code != "" {
+		resp["code"] = code
+	}
+	if len(details) > 0 {
+		resp["details"] = details
+	}
+	return resp
+}
+
+func writeApiError(w http.ResponseWriter, r *http.Request, err error) {
+	writeApiJSON(w, r, apiErrorStatus(err), apiErrorEnvelope(err))
+}
+{{if .Problem}}
+// writeApiProblem пишет ошибку документом RFC 7807 (application/problem+json).
+// Ошибка валидации параметра попадает ещё и в "invalid-params"
+func writeApiProblem(w http.ResponseWriter, r *http.Request, err error, typeBase string) {
+	status := apiErrorStatus(err)
+	problem := map[string]interface{}{
+		"type":     "about:blank",
+		"title":    http.StatusText(status),
+		"status":   status,
+		"detail":   err.Error(),
+		"instance": r.URL.Path,
+	}
+	code, details := apiErrorCode(err)
+	if code != "" {
+		problem["code"] = code
+		if typeBase != "" {
+			problem["type"] = typeBase + code
+		}
+	}
+	if len(details) > 0 {
+		problem["details"] = details
+	}
+	if param, ok := details["param"].(string); ok {
+		problem["invalid-params"] = []map[string]interface{}{
+			{"name": param, "reason": err.Error()},
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem)
+}
+{{end}}
+`))
+
+	validatorTpl = template.Must(template.New("validatorTpl").Funcs(funcs).Parse(`
+func {{.Method.ParamsName}}Validator(r *http.Request) ({{.Method.ParamsName}}, error) {
+	var data {{.Method.ParamsName}}
+{{range .Method.Fields}}
+	// {{.Name}}
+	{{.Name}}Raw := {{if .FromPath}}r.PathValue{{else}}r.FormValue{{end}}({{quote .ParamName}})
+{{- if .Required}}
+	if {{.Name}}Raw == "" {
+		return data, {{$.Errors.New "http.StatusBadRequest" (print .ParamName " must me not empty") "param_required" (.Details "required")}}
+	}
+{{- end}}
+{{- if .Default}}
+	if {{.Name}}Raw == "" {
+		{{.Name}}Raw = {{quote .Default}}
+	}
+{{- end}}
+{{- if .IsInt}}
+	if {{.Name}}Raw != "" {
+		value, err := strconv.Atoi({{.Name}}Raw)
+		if err != nil {
+			return data, {{$.Errors.New "http.StatusBadRequest" (print .ParamName " must be int") "param_not_int" (.Details "int")}}
 		}
-		jsonRaw, _ := json.Marshal(resp)
-		w.Write([]byte(jsonRaw))
+		data.{{.Name}} = value
+	}
+{{- else}}
+	data.{{.Name}} = {{.Name}}Raw
+{{- end}}
+{{- if .Enum}}
+	switch {{.Name}}Raw {
+	case "",{{range $i, $e := .Enum}}{{if $i}},{{end}} {{quote $e}}{{end}}:
+	default:
+		return data, {{$.Errors.New "http.StatusBadRequest" (print .ParamName " must be one of [" .EnumText "]") "param_not_in_enum" (.Details "enum")}}
+	}
+{{- end}}
+{{- if .HasMin}}
+	if {{.Value}} < {{.Min}} {
+		return data, {{$.Errors.New "http.StatusBadRequest" (print .Subject " must be >= " .Min) "param_below_min" (.Details "min")}}
+	}
+{{- end}}
+{{- if .HasMax}}
+	if {{.Value}} > {{.Max}} {
+		return data, {{$.Errors.New "http.StatusBadRequest" (print .Subject " must be <= " .Max) "param_above_max" (.Details "max")}}
+	}
+{{- end}}
+{{end}}
+	return data, nil
+}
+`))
+
+	handlerTpl = template.Must(template.New("handlerTpl").Funcs(funcs).Parse(`
+{{- if .Method.CORS}}
+var {{.Method.CORSVar}} = {{.Method.CORSLiteral}}
+{{end}}
+func (h *{{.Method.ApiName}}) {{.Method.HandlerName}}(w http.ResponseWriter, r *http.Request) {
+	r = withApiRequestID(w, r)
+{{- if .Method.Service.Recorded}}
+	rec := &apiRecorder{ResponseWriter: w}
+	w = rec
+	writeErr := rec.errorWriter({{.Method.Service.ErrorWriter}})
+	start := time.Now()
+{{- if .Method.Service.TracerField}}
+	r, span := startApiSpan({{.Method.Service.Tracer}}, r, {{quote .Method.ApiName}}, {{quote .Method.Name}})
+	defer endApiSpan(span, rec, r)
+{{- end}}
+{{- if .Method.Service.AccessLogField}}
+	defer logApiAccess({{.Method.Service.AccessLog}}, rec, r, {{quote .Method.ApiName}}, {{quote .Method.Name}}, start)
+{{- end}}
+{{- if .Method.Service.Metrics}}
+	defer observeApiRequest(rec, r, {{quote .Method.ApiName}}, {{quote .Method.Name}}, start)
+{{- end}}
+{{- end}}
+	defer recoverApiPanic(w, r, {{.Method.Service.Logger}}, {{.Method.ErrorWriter}})
+{{- if .Method.CORS}}
+	if !allowApiCORS(w, r, &{{.Method.CORSVar}}, {{.Method.Service.Origins}}) {
+		return
+	}
+{{- end}}
+{{- if and .Method.Method (eq .Mode "switch")}}
+	if r.Method != {{quote .Method.Method}} {
+		{{.Method.ErrorWriter}}(w, r, {{.Errors.New "http.StatusNotAcceptable" "bad method" "bad_method" ""}})
+		return
+	}
+{{- end}}
+{{- if .Method.AuthPrincipal}}
+	principal, ok := {{.Method.AuthPrincipal}}
+	if !ok {
+		{{.Method.ErrorWriter}}(w, r, {{.Errors.New "http.StatusForbidden" "unauthorized" "unauthorized" ""}})
 		return
 	}
+	r = r.WithContext(WithPrincipal(r.Context(), principal))
+{{- if .Method.Service.Recorded}}
+	rec.principal = principal
+{{- end}}
+{{- end}}
+{{- if .Method.RateLimit}}
+	// после auth: корзина principal'а, а не общего IP
+	if !allowApiRequest(w, r, {{.Method.Service.Limiter}}, {{.Method.Service.RateLimits}}, {{.Method.RateLimitKey}}, {{.Method.ErrorWriter}}) {
+		return
+	}
+{{- end}}
+{{- if .Method.MaxBodyBytes}}
+
+	r.Body = http.MaxBytesReader(w, r.Body, {{.Method.MaxBodyBytes}})
+{{- end}}
+{{- if .Method.Timeout}}
+
+	ctx, cancel := context.WithTimeout(r.Context(), {{.Method.TimeoutLiteral}})
+	defer cancel()
+	r = r.WithContext(ctx)
+{{- end}}
+{{- if .Method.Idempotent}}
+
+	w, done := beginApiIdempotent(w, r, h.{{.Method.Service.IdempotencyField}}, {{quote (print .Method.ApiName "." .Method.Name)}}, {{if .Method.AuthPrincipal}}principal{{else}}""{{end}}, {{.Method.ErrorWriter}})
+	if done {
+		return
+	}
+	defer finishApiIdempotent(w)
+{{- end}}
+{{- if .Method.ParsesForm}}
 
-	ctx := r.Context()
-	data, err := h.{{.FuncName}}(ctx, in)
+	if err := parseApiForm(r, {{if .Method.Strict}}{{.Method.AllowedParams}}{{else}}nil{{end}}); err != nil {
+		{{.Method.ErrorWriter}}(w, r, err)
+		return
+	}
+{{- end}}
+
+	in, err := {{.Method.ParamsName}}Validator(r)
 	if err != nil {
-		resp["error"] = err.Error()
-		if apiErr, ok := err.(ApiError); ok {
-			w.WriteHeader(apiErr.HTTPStatus)
-		} else {
-			resp["error"] = err.Error()
-			w.WriteHeader(http.StatusBadRequest)
-		}
-		jsonRaw, _ := json.Marshal(resp)
-		w.Write([]byte(jsonRaw))
+		{{.Method.ErrorWriter}}(w, r, err)
 		return
 	}
-	resp["response"] = data
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	err = json.NewEncoder(w).Encode(resp) 
+	res, {{if .Method.Cursor}}nextCursor, {{end}}err := h.{{.Method.Name}}({{if .Method.ETag}}withApiIfMatch(r){{else}}r.Context(){{end}}, in)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeApiMethodError(w, r, err, {{.Method.Service.Logger}}, {{.Method.ErrorWriter}})
+		return
 	}
-	return
+{{- if .Method.ETag}}
+	if !checkApiPreconditions(w, r, res.ETag(), {{.Method.ErrorWriter}}) {
+		return
+	}
+{{- end}}
+{{- if .Method.List}}
 
-	`))
-	authCheck = `
-	auth := r.Header.Get("X-Auth")
-	if auth != "100500" {
-	    http.Error(w, "unauthorized", http.StatusUnauthorized)
+	if apiWantsNDJSON(r) {
+{{- if .Method.Cursor}}
+		w.Header().Set("X-Next-Cursor", nextCursor)
+{{- end}}
+{{- if .Method.Chan}}
+		streamApiNDJSON(w, res)
+{{- else}}
+		writeApiNDJSON(w, res)
+{{- end}}
+		return
 	}
-`
-)
+{{- if .Method.Chan}}
+	items := collectApiChan[{{.Method.ItemType}}](res)
+{{- else}}
+	items := res
+	if items == nil {
+		items = {{.Method.ResultType}}{}
+	}
+{{- end}}
+	{{.Method.Service.ResponseWriter}}(w, r, http.StatusOK, map[string]interface{}{
+		"error":    "",
+		"response": items,
+{{- if .Method.Cursor}}
+		"next_cursor": nextCursor,
+{{- end}}
+	})
+{{- else if .Method.FastJSON}}
+	{{.Method.Service.ResultWriter}}(w, r, res)
+{{- else}}
+	{{.Method.Service.ResponseWriter}}(w, r, http.StatusOK, map[string]interface{}{
+		"error":    "",
+		"response": res,
+	})
+{{- end}}
+}
+`))
 
-func main() {
-	fset := token.NewFileSet()
-	node, err := parser.ParseFile(fset, os.Args[1], nil, parser.ParseComments)
-	if err != nil {
-		log.Fatal(err)
+	problemTpl = template.Must(template.New("problemTpl").Funcs(funcs).Parse(`
+// {{.Service.ErrorWriter}} - ошибки {{.Service.Name}} отдаются в формате RFC 7807
+func {{.Service.ErrorWriter}}(w http.ResponseWriter, r *http.Request, err error) {
+	writeApiProblem(w, r, err, {{quote .Service.ProblemType}})
+}
+`))
+
+	serveTpl = template.Must(template.New("serveTpl").Funcs(funcs).Parse(`
+{{- if .Service.Built}}
+// buildHandler собирает обёртки {{.Service.Name}} вместе с middleware
+func (h *{{.Service.Name}}) buildHandler() (http.Handler, error) {
+	chain := &apiChain{registry: h.{{.Service.RegistryField}}}
+{{- range .Service.Methods}}
+	route{{.HandlerName}} := {{.Handler}}
+{{- end}}
+	dispatch := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+{{- range .Service.Endpoints}}
+		case {{quote .URL}}:
+{{- if .Shared}}
+			switch r.Method {
+{{- range .Methods}}
+{{- if .Method}}
+			case {{quote .Method}}:
+				route{{.HandlerName}}.ServeHTTP(w, r)
+{{- end}}
+{{- end}}
+{{- if .Preflight}}
+			case http.MethodOptions:
+				apiPreflight({{$.Service.PreflightMap .URL}}, {{quote ($.Service.AllowFor .URL)}}, {{$.Service.Origins}}, {{$.Service.ErrorWriter}}).ServeHTTP(w, r)
+{{- end}}
+			default:
+{{- with .Any}}
+				route{{.HandlerName}}.ServeHTTP(w, r)
+{{- else}}
+				apiMethodNotAllowed({{quote ($.Service.AllowFor .URL)}}, {{$.Service.ErrorWriter}}).ServeHTTP(w, r)
+{{- end}}
+			}
+{{- else}}
+			route{{(index .Methods 0).HandlerName}}.ServeHTTP(w, r)
+{{- end}}
+{{- end}}
+{{- range .Service.HealthRoutes}}
+		case {{quote .URL}}:
+			apiHealthOnly({{.Handler}}, {{$.Service.ErrorWriter}}).ServeHTTP(w, r)
+{{- end}}
+		default:
+			apiNotFound({{.Service.ErrorWriter}}).ServeHTTP(w, r)
+		}
+	})
+	return {{.Service.WrapService "dispatch"}}, chain.err
+}
+{{- else}}
+func (h *{{.Service.Name}}) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+{{- range .Service.Endpoints}}
+	case {{quote .URL}}:
+{{- if .Shared}}
+		switch r.Method {
+{{- range .Methods}}
+{{- if .Method}}
+		case {{quote .Method}}:
+			h.{{.HandlerName}}(w, r)
+{{- end}}
+{{- end}}
+{{- if .Preflight}}
+		case http.MethodOptions:
+			apiPreflight({{$.Service.PreflightMap .URL}}, {{quote ($.Service.AllowFor .URL)}}, {{$.Service.Origins}}, {{$.Service.ErrorWriter}}).ServeHTTP(w, r)
+{{- end}}
+		default:
+{{- with .Any}}
+			h.{{.HandlerName}}(w, r)
+{{- else}}
+			apiMethodNotAllowed({{quote ($.Service.AllowFor .URL)}}, {{$.Service.ErrorWriter}}).ServeHTTP(w, r)
+{{- end}}
+		}
+{{- else}}
+		h.{{(index .Methods 0).HandlerName}}(w, r)
+{{- end}}
+{{- end}}
+{{- range .Service.HealthRoutes}}
+	case {{quote .URL}}:
+		apiHealthOnly({{.Handler}}, {{$.Service.ErrorWriter}}).ServeHTTP(w, r)
+{{- end}}
+	default:
+		apiNotFound({{.Service.ErrorWriter}}).ServeHTTP(w, r)
 	}
+}
 
-	out, _ := os.Create(os.Args[2])
+// Handler - сама структура: собирать нечего
+func (h *{{.Service.Name}}) Handler() (http.Handler, error) {
+	return h, nil
+}
+{{- end}}
+`))
 
-	fmt.Fprintln(out, `package `+node.Name.Name)
-	fmt.Fprintln(out)
+	muxTpl = template.Must(template.New("muxTpl").Funcs(funcs).Parse(`
+// RegisterRoutes вешает методы {{.Service.Name}} на mux шаблонами go 1.22.
+// Ошибка - незарегистрированный middleware, такой mux использовать нельзя
+func (h *{{.Service.Name}}) RegisterRoutes(mux *http.ServeMux) error {
+{{- if .Service.HasMiddleware}}
+	chain := &apiChain{registry: h.{{.Service.RegistryField}}}
+{{- end}}
+{{- range .Service.Methods}}
+	mux.Handle({{quote .Pattern}}, {{.MuxHandler}})
+{{- end}}
+{{- range .Service.HealthRoutes}}
+	mux.Handle({{quote (print "GET " .URL)}}, {{$.Service.WrapService .Handler}})
+	mux.Handle({{quote .URL}}, {{$.Service.WrapService (print "apiMethodNotAllowed(\"GET, HEAD\", " $.Service.ErrorWriter ")")}})
+{{- end}}
+{{- range .Service.PreflightRoutes}}
+	mux.Handle({{quote (print "OPTIONS " .URL)}}, {{$.Service.WrapService (print "apiPreflight(" ($.Service.PreflightMap .URL) ", " (quote ($.Service.AllowFor .URL)) ", " $.Service.Origins ", " $.Service.ErrorWriter ")")}})
+{{- end}}
+{{- range .Service.Routes}}
+{{- if not .Any}}
+	mux.Handle({{quote .URL}}, {{$.Service.WrapService (print "apiMethodNotAllowed(" (quote .Allow) ", " $.Service.ErrorWriter ")")}})
+{{- end}}
+{{- end}}
+	return {{if .Service.HasMiddleware}}chain.err{{else}}nil{{end}}
+}
 
-	var importSlice []string
-	for _, name := range []string{"net/http", "slices", "errors", "encoding/json"} {
-		importSlice = append(importSlice, strconv.Quote(name))
+// buildHandler - mux с методами {{.Service.Name}} и 404 на всё остальное
+func (h *{{.Service.Name}}) buildHandler() (http.Handler, error) {
+	mux := http.NewServeMux()
+	if err := h.RegisterRoutes(mux); err != nil {
+		return nil, err
 	}
+{{- if .Service.Middleware}}
+	chain := &apiChain{registry: h.{{.Service.RegistryField}}}
+{{- end}}
+	mux.Handle("/", {{.Service.WrapService (print "apiNotFound(" .Service.ErrorWriter ")")}})
+	return mux, {{if .Service.Middleware}}chain.err{{else}}nil{{end}}
+}
+`))
 
-	importTpl.Execute(out, tpl{
-		Body: strings.Join(importSlice, "\n\t"),
+	builtTpl = template.Must(template.New("builtTpl").Funcs(funcs).Parse(`
+// Handler - обёртки {{.Service.Name}}, собранные при первом вызове и сохранённые
+// в {{.Service.RoutesVar}}. Незарегистрированный middleware - ошибка здесь, при запуске
+func (h *{{.Service.Name}}) Handler() (http.Handler, error) {
+	{{.Service.RoutesVar}}.once.Do(func() {
+		{{.Service.RoutesVar}}.handler, {{.Service.RoutesVar}}.err = h.buildHandler()
 	})
+	return {{.Service.RoutesVar}}.handler, {{.Service.RoutesVar}}.err
+}
 
-	var currentApiName string
-	var currentStructName string
+func (h *{{.Service.Name}}) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler, err := h.Handler()
+	if err != nil {
+		// ошибку сборки должен был увидеть тот, кто вызвал Handler() при запуске
+		{{.Service.ErrorWriter}}(w, r, {{.Errors.New "http.StatusInternalServerError" "internal server error" "internal_error" ""}})
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+`))
 
-	validatorMap := make(map[string]string)
-	var metaSlice []APIMeta
+	routesTpl = template.Must(template.New("routesTpl").Funcs(funcs).Parse(`
+// ApiRoutes - обёртки структуры API, собранные один раз. Поле этого типа
+// нужно структурам с middleware и в режиме -mode=mux
+type ApiRoutes struct {
+	once    sync.Once
+	handler http.Handler
+	err     error
+}
+`))
 
-	for _, f := range node.Decls {
+	registryTpl = template.Must(template.New("registryTpl").Funcs(funcs).Parse(`
+// MiddlewareRegistry - middleware по именам, которые указываются
+// в "middleware" меток apigen:api. Поле этого типа кладётся в структуру API
+type MiddlewareRegistry map[string]func(http.Handler) http.Handler
 
-		switch g := f.(type) {
-		case *ast.GenDecl:
-			for _, spec := range g.Specs {
-				currType, ok := spec.(*ast.TypeSpec)
-				if !ok {
-					fmt.Printf("SKIP %#T is not ast.TypeSpec\n", spec)
-					continue
-				}
-				currStruct, ok := currType.Type.(*ast.StructType)
-				if !ok {
-					fmt.Printf("SKIP %T, не структура", currStruct)
-					continue
-				}
-				if strings.Contains(strings.ToLower(currType.Name.Name), "api") {
-					if currentApiName != currType.Name.Name && len(metaSlice) > 0 {
-						// Новое API подразумевает, что закончили со старым
-						writeServeHTTP(out, currentApiName, metaSlice)
-						metaSlice = nil
-					}
-					currentApiName = currType.Name.Name
-				} else {
-					currentStructName = currType.Name.Name
-				}
-				if strings.Contains(currType.Name.Name, "Params") {
-					apiValidatorText := "apivalidator:"
-
-					fmt.Println("Создаем валидатор для:", currentStructName)
-					methodName := strings.TrimSuffix(currentStructName, "Params")
-					validatorMap[strings.ToLower(methodName)] = currentStructName + "Validator"
-					OpenForm(out, ToCamelCase([]string{currentStructName, "Validator"}), currentStructName)
-
-					for _, field := range currStruct.Fields.List {
-						fieldName := field.Names[0].Name
-						if field.Tag != nil && strings.Contains(field.Tag.Value, apiValidatorText) {
-							param, _ := strconv.Unquote(field.Tag.Value)
-							param = param[len(apiValidatorText):]
-							param, _ = strconv.Unquote(param)
-							params := strings.Split(param, ",")
-							fieldMeta := FieldMeta{}
-							fieldMeta.Name = fieldName
-							fieldMeta.ParamName = fieldName
-
-							for _, param := range params {
-								if param == "required" {
-									fieldMeta.Required = true
-								}
-
-								if strings.Contains(param, "=") {
-									paramSlice := strings.Split(param, "=")
-									if len(paramSlice) == 2 {
-										if paramSlice[0] == "default" {
-											fieldMeta.Default = paramSlice[1]
-
-										}
-										if paramSlice[0] == "enum" {
-											fieldMeta.Enum = strings.Split(paramSlice[1], "|")
-
-										}
-										if paramSlice[0] == "max" {
-											value, err := strconv.Atoi(paramSlice[1])
-											if err != nil {
-												fieldMeta.Max = value
-											}
-										}
-										if paramSlice[0] == "min" {
-											value, err := strconv.Atoi(paramSlice[1])
-											if err != nil {
-												fieldMeta.Min = value
-											}
-										}
-										if paramSlice[0] == "paramname" {
-											fieldMeta.ParamName = paramSlice[1]
-
-										}
-									}
-								}
-
-							}
-							fieldMeta.RequiredCheck(out)
-							fieldMeta.DefaultCheck(out)
-							fieldMeta.EnumCheck(out)
-							fieldMeta.MaxCheck(out)
-							fieldMeta.MinCheck(out)
-
-						}
-					}
-					CloseForm(out)
+// Use регистрирует middleware под именем name
+func (reg *MiddlewareRegistry) Use(name string, mw func(http.Handler) http.Handler) {
+	if *reg == nil {
+		*reg = MiddlewareRegistry{}
+	}
+	(*reg)[name] = mw
+}
 
-				}
-			}
+// Wrap оборачивает next в middleware в порядке names - первая самая внешняя.
+// Незарегистрированное имя - ошибка
+func (reg MiddlewareRegistry) Wrap(next http.Handler, names ...string) (http.Handler, error) {
+	for i := len(names) - 1; i >= 0; i-- {
+		mw, ok := reg[names[i]]
+		if !ok {
+			return nil, fmt.Errorf("apigen: middleware %q is not registered", names[i])
+		}
+		next = mw(next)
+	}
+	return next, nil
+}
 
-		case *ast.FuncDecl:
-			if g.Doc == nil {
-				fmt.Printf("SKIP структура %#v не имеет комментов\n", g.Name.Name)
-				continue
-			}
-			needCodegen := false
-			var methodJson string
-			for _, comment := range g.Doc.List {
-				needCodegen = strings.HasPrefix(comment.Text, "// apigen:api ")
-				sepIdx := strings.Index(comment.Text, "{")
-				if sepIdx == -1 {
-					continue
-				}
-				methodJson = comment.Text[sepIdx:]
-				fmt.Printf("SKIP, %#v не имеет префикса apigen:api\n", g.Name.Name)
-				continue
+// apiChain - Wrap для сборки обёрток: первая ошибка запоминается
+// и возвращается вместе с собранным handler
+type apiChain struct {
+	registry MiddlewareRegistry
+	err      error
+}
+
+func (chain *apiChain) Wrap(next http.Handler, names ...string) http.Handler {
+	wrapped, err := chain.registry.Wrap(next, names...)
+	if err != nil {
+		if chain.err == nil {
+			chain.err = err
+		}
+		return next
+	}
+	return wrapped
+}
+`))
+)
+
+func generate(node *ast.File, defaults Defaults) ([]byte, error) {
+	base, structs, err := parseAPI(node, defaults)
+	if err != nil {
+		return nil, err
+	}
+	return render(node, base, structs)
+}
+
+// parseAPI собирает структуры API и их методы из файла
+func parseAPI(node *ast.File, defaults Defaults) (tpl, map[string]*ast.StructType, error) {
+	mode := defaults.Mode
+	if mode != modeSwitch && mode != modeMux {
+		return tpl{}, nil, fmt.Errorf("unknown mode %q", mode)
+	}
+	structs, configs := collectStructs(node, defaults.API)
+	services := collect(node, mode, structs, configs)
+	base := tpl{Mode: mode, Services: services, Errors: newErrorMeta(structs["ApiError"])}
+	base.Codecs = map[string]bool{}
+	for _, srv := range services {
+		base.Problem = base.Problem || srv.Format == formatProblem
+		if srv.Negotiate() {
+			for _, name := range srv.Encoders {
+				base.Codecs[name] = true
 			}
-			var meta APIMeta
-			err := json.Unmarshal([]byte(methodJson), &meta)
-			if err != nil {
-				panic(err)
+		}
+	}
+	return base, structs, nil
+}
+
+// render пишет api_handlers.go
+func render(node *ast.File, base tpl, structs map[string]*ast.StructType) ([]byte, error) {
+	mode, services := base.Mode, base.Services
+
+	imports := map[string]bool{
+		"context":       true,
+		"encoding/json": true,
+		"errors":        true,
+		"log":           true,
+		"net/http":      true,
+		"runtime/debug": true,
+	}
+
+	var body bytes.Buffer
+	// execute пишет шаблон в body и запоминает первую ошибку: без неё
+	// пропавший кусок обёрток всплыл бы только при компиляции
+	var tplErr error
+	execute := func(t *template.Template, data interface{}) {
+		if err := t.Execute(&body, data); err != nil && tplErr == nil {
+			tplErr = fmt.Errorf("%s: %w", t.Name(), err)
+		}
+	}
+	execute(helpersTpl, base)
+	for _, srv := range services {
+		if srv.Built || srv.RoutesField != "" {
+			execute(routesTpl, base)
+			imports["sync"] = true
+			break
+		}
+	}
+	execute(requestIDTpl, base)
+	imports["crypto/rand"] = true
+	imports["encoding/hex"] = true
+	for _, srv := range services {
+		if srv.RegistryField != "" {
+			execute(registryTpl, base)
+			imports["fmt"] = true
+			break
+		}
+	}
+	for _, srv := range services {
+		if len(base.Codecs) > 0 || srv.HasLists() {
+			execute(acceptTpl, base)
+			imports["strconv"] = true
+			imports["strings"] = true
+			break
+		}
+	}
+	if len(base.Codecs) > 0 {
+		execute(encodersTpl, base)
+		for _, name := range codecImports(base.Codecs) {
+			imports[name] = true
+		}
+	}
+	for _, srv := range services {
+		if srv.HasLists() {
+			execute(streamTpl, base)
+			imports["strings"] = true
+			imports["time"] = true
+			break
+		}
+	}
+
+	for _, srv := range services {
+		if srv.HasETags() {
+			execute(etagTpl, base)
+			imports["context"] = true
+			imports["strings"] = true
+			break
+		}
+	}
+
+	for _, srv := range services {
+		if srv.HasIdempotent() {
+			execute(idempotencyTpl, base)
+			for _, name := range []string{"bytes", "context", "crypto/sha256", "encoding/hex", "io", "sync", "time"} {
+				imports[name] = true
 			}
-			path := strings.Trim(meta.URL, "/")
-			parts := strings.Split(path, "/")
-			if len(parts) >= 2 {
-				meta.Entity = parts[0]
-				meta.Action = parts[1]
+			break
+		}
+	}
+
+	if hasAuthSecrets(services) {
+		execute(authTpl, base)
+		imports["crypto/subtle"] = true
+	}
+	if hasMTLS(services) {
+		execute(mtlsTpl, base)
+	}
+	if hasRateLimits(services) || hasAccessLog(services) || hasAuthSecrets(services) || hasMTLS(services) {
+		execute(principalTpl, base)
+		imports["net"] = true
+	}
+	if hasRateLimits(services) {
+		execute(rateLimitTpl, base)
+		for _, name := range []string{"fmt", "math", "strconv", "sync", "time"} {
+			imports[name] = true
+		}
+	}
+	if hasRecorder(services) {
+		execute(recorderTpl, base)
+		imports["time"] = true
+	}
+	if hasMetrics(services) {
+		execute(metricsTpl, base)
+		for _, name := range []string{"fmt", "sort", "strconv", "strings", "sync"} {
+			imports[name] = true
+		}
+	}
+	if hasTracing(services) {
+		execute(tracingTpl, base)
+		for _, name := range []string{"context", "strings", "sync"} {
+			imports[name] = true
+		}
+	}
+	if hasAccessLog(services) {
+		execute(accessLogTpl, base)
+		imports["log/slog"] = true
+		imports["time"] = true
+	}
+
+	if needsBodyHelpers(services) {
+		execute(bodyTpl, base)
+		imports["sort"] = true
+	}
+	if hasCORS(services) {
+		execute(corsTpl, base)
+		imports["strings"] = true
+	}
+	if hasHealth(services) {
+		execute(healthTpl, base)
+	}
+	if hasTimeouts(services) {
+		imports["time"] = true
+	}
+
+	fastJSON := markFastJSON(services, structs)
+	if len(fastJSON) > 0 {
+		execute(jsonHelpersTpl, base)
+		for _, data := range fastJSON {
+			execute(jsonStructTpl, data)
+			for _, field := range data.Fields {
+				imports["strconv"] = imports["strconv"] || strings.HasPrefix(field.Append, "strconv.")
 			}
+		}
+		imports["sync"] = true
+		imports["unicode/utf8"] = true
+	}
+	if base.Codecs[codecBinpack] {
+		for _, name := range binpackResults(services) {
+			execute(binpackTpl, binpackStruct(name, structs[name]))
+		}
+	}
 
-			if needCodegen {
-				metaSlice = append(metaSlice, meta)
-				var body string
-				if meta.Auth {
-					body = authCheck
-				} else {
-					body = ""
-				}
-				fmt.Println(meta)
-				apiSuffix := strings.Trim(currentApiName, "Api")
-				if apiSuffix == "My" {
-					apiSuffix = ToCamelCase([]string{validatorMap[meta.Action]})
-				} else {
-					apiSuffix = ToCamelCase([]string{apiSuffix, validatorMap[meta.Action]})
+	validated := map[string]bool{}
+	for _, srv := range services {
+		for _, method := range srv.Methods {
+			if !validated[method.ParamsName] {
+				validated[method.ParamsName] = true
+				for _, field := range method.Fields {
+					imports["strconv"] = imports["strconv"] || field.IsInt()
 				}
-				body += FillJobTemplate(ToCamelCase([]string{meta.Action}), apiSuffix)
-
-				fmt.Println("Создаем хэндлер для:", currentApiName, meta.Entity, meta.Action)
-				methodTpl.Execute(out, tpl{
-					ApiName:  currentApiName,
-					FuncName: ToCamelCase([]string{meta.Entity, meta.Action}),
-					Body:     body,
-				})
+				execute(validatorTpl, base.with(srv, method))
 			}
-		default:
-			fmt.Printf("SKIP %#T is not *ast.GenDecl/*ast.FuncDecl\n", f)
-			continue
+			execute(handlerTpl, base.with(srv, method))
+		}
+		if srv.Format == formatProblem {
+			execute(problemTpl, base.with(srv, nil))
+		}
+		if srv.Negotiate() {
+			execute(negotiateTpl, base.with(srv, nil))
+		}
+		if mode == modeMux {
+			execute(muxTpl, base.with(srv, nil))
+		} else {
+			execute(serveTpl, base.with(srv, nil))
+		}
+		if srv.Built {
+			execute(builtTpl, base.with(srv, nil))
+		}
+	}
+
+	if tplErr != nil {
+		return nil, tplErr
+	}
+
+	var importSlice []string
+	for name, used := range imports {
+		if used {
+			importSlice = append(importSlice, strconv.Quote(name))
 		}
 	}
-	// последняя проверка
-	if len(metaSlice) > 0 {
-		writeServeHTTP(out, currentApiName, metaSlice)
+	sort.Strings(importSlice)
+
+	var out bytes.Buffer
+	fmt.Fprintln(&out, "// Code generated by handlers_gen. DO NOT EDIT.")
+	fmt.Fprintln(&out)
+	fmt.Fprintln(&out, "package "+node.Name.Name)
+	fmt.Fprintln(&out)
+	fmt.Fprintf(&out, "import (\n\t%s\n)\n", strings.Join(importSlice, "\n\t"))
+	out.Write(body.Bytes())
+
+	return format.Source(out.Bytes())
+}
+
+func main() {
+	mode := flag.String("mode", modeSwitch, "как генерировать ServeHTTP: switch по r.URL.Path или mux (шаблоны http.ServeMux из go 1.22)")
+	defaultsPath := flag.String("defaults", "", "json с режимом и меткой apigen:api по-умолчанию для всех структур API")
+	version := flag.Bool("version", false, "напечатать версию генератора")
+	tests := flag.String("tests", "", "куда записать табличные тесты обёрток из тегов apivalidator, например api_handlers_test.go")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] api.go api_handlers.go\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *version {
+		fmt.Println("handlers_gen", generatorVersion)
+		return
+	}
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	fset := token.NewFileSet()
+	node, err := parser.ParseFile(fset, flag.Arg(0), nil, parser.ParseComments)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defaults := Defaults{Mode: modeSwitch}
+	if *defaultsPath != "" {
+		if defaults, err = loadDefaults(*defaultsPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// флаг главнее файла
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "mode" {
+			defaults.Mode = *mode
+		}
+	})
+
+	base, structs, err := parseAPI(node, defaults)
+	if err != nil {
+		log.Fatal(err)
+	}
+	src, err := render(node, base, structs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = os.WriteFile(flag.Arg(1), src, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *tests == "" {
+		return
+	}
+	src, err = generateTests(node, base)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = os.WriteFile(*tests, src, 0644)
+	if err != nil {
+		log.Fatal(err)
 	}
 }
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"go/parser"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runGenerated копирует testdata/<dir> во временный модуль, генерирует
+// api_handlers.go в указанном режиме и гоняет там go test
+func runGenerated(t *testing.T, dir, mode string) {
+	t.Helper()
+	tmp, src := generateFixture(t, dir, mode, false)
+	if out, err := goTest(tmp); err != nil {
+		t.Fatalf("go test in generated module failed: %v\n%s\n%s", err, out, src)
+	}
+}
+
+// generateFixture - временный модуль из testdata/<dir> со сгенерированным
+// api_handlers.go, а с withTests - и с api_handlers_test.go, как от -tests
+func generateFixture(t *testing.T, dir, mode string, withTests bool) (string, []byte) {
+	t.Helper()
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go toolchain not found")
+	}
+
+	tmp := t.TempDir()
+	files, err := filepath.Glob(filepath.Join("testdata", dir, "*.go"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no fixtures in testdata/%s: %v", dir, err)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(tmp, filepath.Base(file)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "go.mod"), []byte("module fixture\n\ngo 1.22\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := parser.ParseFile(token.NewFileSet(), filepath.Join(tmp, "api.go"), nil, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, structs, err := parseAPI(node, Defaults{Mode: mode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := render(node, base, structs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, "api_handlers.go"), src, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if withTests {
+		tests, err := generateTests(node, base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(tmp, "api_handlers_test.go"), tests, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tmp, src
+}
+
+func goTest(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("go", append([]string{"test"}, append(args, "./...")...)...)
+	cmd.Dir = dir
+	return cmd.CombinedOutput()
+}
+
+func TestMuxMode(t *testing.T) {
+	runGenerated(t, "mux", modeMux)
+}
+
+func TestMiddleware(t *testing.T) {
+	for _, mode := range []string{modeSwitch, modeMux} {
+		t.Run(mode, func(t *testing.T) {
+			runGenerated(t, "middleware", mode)
+		})
+	}
+}
+
+func TestRecover(t *testing.T) {
+	runGenerated(t, "recover", modeSwitch)
+}
+
+func TestProblem(t *testing.T) {
+	for _, mode := range []string{modeSwitch, modeMux} {
+		t.Run(mode, func(t *testing.T) {
+			runGenerated(t, "problem", mode)
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	runGenerated(t, "negotiate", modeSwitch)
+}
+
+func TestStream(t *testing.T) {
+	runGenerated(t, "stream", modeSwitch)
+}
+
+func TestIdempotent(t *testing.T) {
+	runGenerated(t, "idempotent", modeSwitch)
+}
+
+func TestRateLimit(t *testing.T) {
+	for _, mode := range []string{modeSwitch, modeMux} {
+		t.Run(mode, func(t *testing.T) {
+			runGenerated(t, "ratelimit", mode)
+		})
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	runGenerated(t, "timeout", modeSwitch)
+}
+
+func TestCORS(t *testing.T) {
+	runGenerated(t, "cors", modeMux)
+}
+
+func TestHealth(t *testing.T) {
+	for _, mode := range []string{modeSwitch, modeMux} {
+		t.Run(mode, func(t *testing.T) {
+			runGenerated(t, "health", mode)
+		})
+	}
+}
+
+// несколько методов на одном URL: один case в switch, в mux - без 405
+// поверх метода без "method". Вместе со сгенерированными тестами
+func TestSharedURL(t *testing.T) {
+	for _, mode := range []string{modeSwitch, modeMux} {
+		t.Run(mode, func(t *testing.T) {
+			tmp, src := generateFixture(t, "shared", mode, true)
+			if out, err := goTest(tmp, "-v"); err != nil {
+				t.Fatalf("go test in generated module failed: %v\n%s\n%s", err, out, src)
+			}
+		})
+	}
+}
+
+// опечатка в метке - ошибка генерации, а не метод без auth и лимита.
+// log.Fatalf завершает процесс, поэтому разбор - в дочернем процессе теста
+func TestAnnotationUnknownField(t *testing.T) {
+	cases := map[string]string{
+		"method": `// apigen:api {"url": "/x", "rate_limt": "1/s", "timout": "1s", "auht": true}
+func (srv *XApi) Get(ctx context.Context, in XParams) (*X, error) { return nil, nil }`,
+		"struct": `// apigen:api {"metric": true}
+type YApi struct{}`,
+	}
+	if name := os.Getenv("APIGEN_ANNOTATION"); name != "" {
+		src := "package main\n\ntype XApi struct{}\n\ntype XParams struct{}\n\ntype X struct{}\n\n" + cases[name] + "\n"
+		node, err := parser.ParseFile(token.NewFileSet(), "api.go", src, parser.ParseComments)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parseAPI(node, Defaults{Mode: modeSwitch})
+		return
+	}
+
+	for name, unknown := range map[string]string{"method": "rate_limt", "struct": "metric"} {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestAnnotationUnknownField$")
+		cmd.Env = append(os.Environ(), "APIGEN_ANNOTATION="+name)
+		out, err := cmd.CombinedOutput()
+		if err == nil || !strings.Contains(string(out), `unknown field "`+unknown+`"`) {
+			t.Errorf("[%s] expected generation to fail on %q, got %v:\n%s", name, unknown, err, out)
+		}
+	}
+}
+
+// метка над структурой главнее -defaults, "cors" из неё заменяет общий целиком
+func TestDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "defaults.json")
+	data := `{"mode": "mux", "api": {"format": "problem", "max_body": "1KB", "cors": {"origins": ["https://a.example.com"]}}}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defaults, err := loadDefaults(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := `package main
+
+type PlainApi struct{}
+
+// apigen:api {"format": "envelope", "cors": {"origins": ["https://b.example.com"]}}
+type OwnApi struct{}
+`
+	node, err := parser.ParseFile(token.NewFileSet(), "api.go", src, parser.ParseComments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, configs := collectStructs(node, defaults.API)
+	plain, own := configs["PlainApi"], configs["OwnApi"]
+	if plain.Format != formatProblem || plain.MaxBody != "1KB" || plain.CORS == nil || plain.CORS.Origins[0] != "https://a.example.com" {
+		t.Errorf("defaults not applied: %+v", plain)
+	}
+	if own.Format != formatEnvelope || own.MaxBody != "1KB" || own.CORS == nil || len(own.CORS.Origins) != 1 || own.CORS.Origins[0] != "https://b.example.com" {
+		t.Errorf("annotation must override defaults: %+v", own)
+	}
+	if base, _, err := parseAPI(node, defaults); err != nil || base.Mode != modeMux {
+		t.Errorf("mode from defaults: %q, %v", base.Mode, err)
+	}
+
+	for _, bad := range []string{`{"mode": "tree"}`, `{"api": {"format": "xml"}}`, `{"api": {"maxbody": "1KB"}}`} {
+		if err := os.WriteFile(path, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadDefaults(path); err == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+}
+
+func TestGeneratedTests(t *testing.T) {
+	for _, mode := range []string{modeSwitch, modeMux} {
+		t.Run(mode, func(t *testing.T) {
+			tmp, _ := generateFixture(t, "gentests", mode, true)
+			out, err := goTest(tmp, "-v")
+			if err != nil {
+				t.Fatalf("generated tests failed: %v\n%s", err, out)
+			}
+			for _, name := range []string{
+				"TestShopApiGenerated/Order_bad_method",
+				"TestShopApiGenerated/Order_wrong_X-Auth",
+				"TestShopApiGenerated/Order_item_missing",
+				"TestShopApiGenerated/Order_item_above_max",
+				"TestShopApiGenerated/Order_count_default",
+				"TestShopApiGenerated/Order_size_not_in_enum",
+				"TestShopApiGenerated/Search_q_above_max",
+				"TestAdminApiGenerated/Ban_days_not_int",
+				"TestAdminApiGenerated/Whoami_without_auth",
+			} {
+				if !strings.Contains(string(out), "--- PASS: "+name) {
+					t.Errorf("no passed %s in:\n%s", name, out)
+				}
+			}
+		})
+	}
+}
+
+// сгенерированные тесты должны ловить обёртки, которые разошлись с тегами
+func TestGeneratedTestsCatchChanges(t *testing.T) {
+	cases := []struct {
+		old, new string
+		failed   string
+	}{
+		{"len(data.Item) > 8", "len(data.Item) > 9", "Order_item_above_max"},
+		{`"days must be int"`, `"days is not a number"`, "Ban_days_not_int"},
+		{`ColorRaw = "red"`, `ColorRaw = ""`, "Order_color_default"},
+		// подходит под enum и метод его примет - ловит только проверка значения
+		{`ColorRaw = "red"`, `ColorRaw = "green"`, "Order_color_default"},
+	}
+	for _, tc := range cases {
+		tmp, src := generateFixture(t, "gentests", modeSwitch, true)
+		if !bytes.Contains(src, []byte(tc.old)) {
+			t.Fatalf("no %s in generated code", tc.old)
+		}
+		src = bytes.Replace(src, []byte(tc.old), []byte(tc.new), 1)
+		if err := os.WriteFile(filepath.Join(tmp, "api_handlers.go"), src, 0644); err != nil {
+			t.Fatal(err)
+		}
+		out, err := goTest(tmp, "-v")
+		if err == nil || !strings.Contains(string(out), "--- FAIL: TestShopApiGenerated/"+tc.failed) &&
+			!strings.Contains(string(out), "--- FAIL: TestAdminApiGenerated/"+tc.failed) {
+			t.Errorf("expected %s to fail after %s -> %s:\n%s", tc.failed, tc.old, tc.new, out)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// тип поля с origins вместо указанных в метках
+const corsOrigins = "CORSOrigins"
+
+// Origins - поле типа CORSOrigins или nil, тогда origins из меток
+func (srv *ServiceMeta) Origins() string {
+	if srv.OriginsField == "" {
+		return "nil"
+	}
+	return "h." + srv.OriginsField
+}
+
+// CORSConfig - "cors" в метке структуры API (для всех методов) или метода
+// (заменяет настройки структуры целиком)
+type CORSConfig struct {
+	Origins     []string `json:"origins"`
+	Methods     []string `json:"methods"`
+	Headers     []string `json:"headers"`
+	Expose      []string `json:"expose"`
+	Credentials bool     `json:"credentials"`
+	MaxAge      int      `json:"max_age"`
+}
+
+// checkCORS выбирает настройки метода и проверяет их
+func checkCORS(method *MethodMeta, srv *ServiceMeta) {
+	if method.CORS == nil {
+		method.CORS = srv.CORS
+	}
+	if method.CORS == nil {
+		return
+	}
+	// копия: у методов одной структуры общий srv.CORS, а Methods у каждого свой
+	cors := *method.CORS
+	method.CORS = &cors
+	if len(cors.Origins) == 0 {
+		log.Fatalf("%s.%s: cors without origins", method.ApiName, method.Name)
+	}
+	for _, origin := range cors.Origins {
+		if origin == "*" && cors.Credentials {
+			log.Fatalf("%s.%s: cors credentials can not be used with origin \"*\"", method.ApiName, method.Name)
+		}
+	}
+	// метод обёртки главнее списка из настроек - preflight не обещает лишнего
+	if method.Method != "" {
+		cors.Methods = []string{method.Method}
+	}
+	if len(cors.Methods) == 0 {
+		cors.Methods = []string{"GET", "POST"}
+	}
+}
+
+// CORSVar - переменная с настройками CORS обёртки
+func (method *MethodMeta) CORSVar() string {
+	return "cors" + method.ApiName + method.HandlerName
+}
+
+// CORSLiteral - apiCORS{...} для сгенерированного кода
+func (method *MethodMeta) CORSLiteral() string {
+	return corsLiteral(method.CORS, strings.Join(method.CORS.Methods, ", "))
+}
+
+func corsLiteral(cors *CORSConfig, methods string) string {
+	var origins []string
+	for _, origin := range cors.Origins {
+		origins = append(origins, strconv.Quote(origin))
+	}
+	parts := []string{
+		"origins: []string{" + strings.Join(origins, ", ") + "}",
+		"methods: " + strconv.Quote(methods),
+	}
+	if len(cors.Headers) > 0 {
+		parts = append(parts, "headers: "+strconv.Quote(strings.Join(cors.Headers, ", ")))
+	}
+	if len(cors.Expose) > 0 {
+		parts = append(parts, "expose: "+strconv.Quote(strings.Join(cors.Expose, ", ")))
+	}
+	if cors.Credentials {
+		parts = append(parts, "credentials: true")
+	}
+	if cors.MaxAge > 0 {
+		parts = append(parts, "maxAge: "+strconv.Quote(strconv.Itoa(cors.MaxAge)))
+	}
+	return "apiCORS{" + strings.Join(parts, ", ") + "}"
+}
+
+// PreflightRoutes - в режиме mux OPTIONS не попадает на "POST /user/create",
+// поэтому для URL с CORS вешаем отдельный маршрут "OPTIONS /user/create".
+// Методы без "method" ловят OPTIONS сами
+func (srv *ServiceMeta) PreflightRoutes() []*MethodMeta {
+	var routes []*MethodMeta
+	seen := map[string]bool{}
+	for _, method := range srv.Methods {
+		if method.CORS == nil || method.Method == "" || seen[method.URL] {
+			continue
+		}
+		seen[method.URL] = true
+		routes = append(routes, method)
+	}
+	return routes
+}
+
+// PreflightMap - настройки CORS методов URL по HTTP-методу: preflight
+// отвечает по настройкам того метода, который браузер собирается вызвать
+func (srv *ServiceMeta) PreflightMap(url string) string {
+	var items []string
+	for _, method := range srv.Methods {
+		if method.URL == url && method.CORS != nil && method.Method != "" {
+			items = append(items, strconv.Quote(method.Method)+": &"+method.CORSVar())
+		}
+	}
+	return "map[string]*apiCORS{" + strings.Join(items, ", ") + "}"
+}
+
+func hasCORS(services []*ServiceMeta) bool {
+	for _, srv := range services {
+		for _, method := range srv.Methods {
+			if method.CORS != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var corsTpl = template.Must(template.New("corsTpl").Funcs(funcs).Parse(`
+// apiCORS - настройки CORS одной обёртки из меток apigen:api
+type apiCORS struct {
+	origins     []string
+	methods     string
+	headers     string
+	expose      string
+	credentials bool
+	maxAge      string
+}
+
+// apiCORSAll - настройки всех обёрток с CORS, по ним проверяется CORSOrigins
+var apiCORSAll = []*apiCORS{
+{{- range .Services}}
+{{- range .Methods}}
+{{- if .CORS}}
+	&{{.CORSVar}},
+{{- end}}
+{{- end}}
+{{- end}}
+}
+
+// CORSOrigins - origins вместо указанных в метках у всех обёрток с CORS,
+// например из файла настроек. Поле этого типа в структуре API, пустое - как в метках
+type CORSOrigins []string
+
+// Check - ошибка, если "*" попал к обёрткам с credentials
+func (origins CORSOrigins) Check() error {
+	for _, cors := range apiCORSAll {
+		for _, origin := range origins {
+			if origin == "*" && cors.credentials {
+				return errors.New("cors: origin \"*\" can not be used with credentials")
+			}
+		}
+	}
+	return nil
+}
+
+func (cors *apiCORS) allowOrigin(origin string, origins CORSOrigins) (string, bool) {
+	if len(origins) == 0 {
+		origins = cors.origins
+	}
+	for _, allowed := range origins {
+		if allowed == "*" {
+			return "*", true
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+func (cors *apiCORS) allowMethod(method string) bool {
+	for _, allowed := range strings.Split(cors.methods, ", ") {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allowApiCORS ставит заголовки CORS ответа - в том числе на ошибки, иначе
+// браузер не покажет их клиенту. Preflight (OPTIONS с Access-Control-Request-Method)
+// обёртка до метода не доводит: ответ 204 и false. Чужой origin или метод -
+// тот же 204, но без разрешающих заголовков, браузер запрос не отправит.
+// origins - из поля CORSOrigins структуры, пустые - из метки
+func allowApiCORS(w http.ResponseWriter, r *http.Request, cors *apiCORS, origins CORSOrigins) bool {
+	header := w.Header()
+	// ответ зависит от Origin, даже если его не было - иначе кеш отдаст
+	// браузеру закешированный ответ без Access-Control-Allow-Origin
+	header.Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	allowOrigin, allowed := cors.allowOrigin(origin, origins)
+	if allowed {
+		header.Set("Access-Control-Allow-Origin", allowOrigin)
+		if cors.credentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+	if !preflight {
+		if allowed && cors.expose != "" {
+			header.Set("Access-Control-Expose-Headers", cors.expose)
+		}
+		return true
+	}
+
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+	if allowed && cors.allowMethod(r.Header.Get("Access-Control-Request-Method")) {
+		header.Set("Access-Control-Allow-Methods", cors.methods)
+		if cors.headers != "" {
+			header.Set("Access-Control-Allow-Headers", cors.headers)
+		}
+		if cors.maxAge != "" {
+			header.Set("Access-Control-Max-Age", cors.maxAge)
+		}
+	} else {
+		header.Del("Access-Control-Allow-Origin")
+		header.Del("Access-Control-Allow-Credentials")
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return false
+}
+
+{{- if or (eq .Mode "mux") .SharedURL}}
+
+// apiPreflight - маршрут "OPTIONS /url" режима mux или URL с несколькими
+// методами в режиме switch. Если метода из
+// Access-Control-Request-Method на URL нет, берутся настройки первого из allow -
+// метод они всё равно не разрешат. OPTIONS без Access-Control-Request-Method -
+// обычный запрос не тем методом
+func apiPreflight(byMethod map[string]*apiCORS, allow string, origins CORSOrigins, writeErr apiErrorWriter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cors, ok := byMethod[r.Header.Get("Access-Control-Request-Method")]
+		for _, method := range strings.Split(allow, ", ") {
+			if ok {
+				break
+			}
+			cors, ok = byMethod[method]
+		}
+		if allowApiCORS(w, r, cors, origins) {
+			apiMethodNotAllowed(allow, writeErr).ServeHTTP(w, r)
+		}
+	})
+}
+{{- end}}
+`))
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Defaults - настройки генератора из файла -defaults, общие для всех файлов
+// проекта: режим и метка apigen:api над каждой структурой API. Флаг -mode
+// и метка над самой структурой главнее
+type Defaults struct {
+	Mode string `json:"mode"`
+	// API - как метка над структурой: поле из метки заменяет такое же отсюда,
+	// "cors" - целиком
+	API ServiceConfig `json:"api"`
+}
+
+// loadDefaults читает и проверяет файл -defaults. Неизвестное поле - ошибка,
+// как и в метках
+func loadDefaults(path string) (Defaults, error) {
+	defaults := Defaults{Mode: modeSwitch}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return defaults, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&defaults); err != nil {
+		return defaults, fmt.Errorf("%s: %w", path, err)
+	}
+	if defaults.Mode != modeSwitch && defaults.Mode != modeMux {
+		return defaults, fmt.Errorf("%s: unknown mode %q", path, defaults.Mode)
+	}
+	if format := defaults.API.Format; format != "" && format != formatEnvelope && format != formatProblem {
+		return defaults, fmt.Errorf("%s: unknown format %q", path, format)
+	}
+	defaults.API.Encoders = checkEncoders(path, defaults.API.Encoders)
+	return defaults, nil
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"go/ast"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"text/template"
+)
+
+// форматы ответа, которые можно перечислить в "encoders" метки над структурой API
+const (
+	codecJSON    = "json"
+	codecMsgpack = "msgpack"
+	codecBinpack = "binpack"
+)
+
+// checkEncoders проверяет имена форматов и ставит json первым - он же
+// ответ по-умолчанию, когда Accept пустой или ничего из него не подошло
+func checkEncoders(apiName string, encoders []string) []string {
+	if len(encoders) == 0 {
+		return nil
+	}
+	result := []string{codecJSON}
+	for _, name := range encoders {
+		switch name {
+		case codecJSON:
+		case codecMsgpack, codecBinpack:
+			result = append(result, name)
+		default:
+			log.Fatalf("%s: unknown encoder %q", apiName, name)
+		}
+	}
+	return result
+}
+
+// Negotiate - нужно ли выбирать формат ответа по Accept
+func (srv *ServiceMeta) Negotiate() bool {
+	return len(srv.Encoders) > 1
+}
+
+// EncoderVars - переменные apiEncoder для форматов структуры
+func (srv *ServiceMeta) EncoderVars() []string {
+	vars := map[string]string{
+		codecJSON:    "apiJSONEncoder",
+		codecMsgpack: "apiMsgpackEncoder",
+		codecBinpack: "apiBinpackEncoder",
+	}
+	var result []string
+	for _, name := range srv.Encoders {
+		result = append(result, vars[name])
+	}
+	return result
+}
+
+func codecImports(codecs map[string]bool) []string {
+	imports := []string{"io", "strconv", "strings"}
+	if codecs[codecMsgpack] {
+		imports = append(imports, "encoding/binary", "math", "reflect", "sort")
+	}
+	if codecs[codecBinpack] {
+		imports = append(imports, "encoding/binary", "reflect")
+	}
+	return imports
+}
+
+// binpackResults - типы результатов методов тех API, что отдают binpack
+func binpackResults(services []*ServiceMeta) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, srv := range services {
+		if !srv.Negotiate() {
+			continue
+		}
+		for _, name := range srv.Encoders {
+			if name != codecBinpack {
+				continue
+			}
+			for _, method := range srv.Methods {
+				if !seen[method.ResultName] {
+					seen[method.ResultName] = true
+					names = append(names, method.ResultName)
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+type binpackField struct {
+	Name   string
+	Append string
+}
+
+type binpackTplData struct {
+	StructName string
+	Fields     []binpackField
+}
+
+// binpackStruct раскладывает поля результата так же, как example/gen:
+// int - uint32, строки - uint32 длина + байты, всё little endian.
+// Поля с тегом cgen:"-" пропускаются
+func binpackStruct(name string, st *ast.StructType) binpackTplData {
+	if st == nil {
+		log.Fatalf("binpack: result type %s is not a struct in this file", name)
+	}
+	data := binpackTplData{StructName: name}
+	for _, field := range st.Fields.List {
+		if field.Tag != nil {
+			tag, _ := strconv.Unquote(field.Tag.Value)
+			if reflect.StructTag(tag).Get("cgen") == "-" {
+				continue
+			}
+		}
+		fieldType := typeName(field.Type)
+		for _, ident := range field.Names {
+			value := "in." + ident.Name
+			var code string
+			switch fieldType {
+			case "int", "int32", "uint32":
+				code = "binary.LittleEndian.AppendUint32(buf, uint32(" + value + "))"
+			case "int64", "uint64", "uint":
+				code = "binary.LittleEndian.AppendUint64(buf, uint64(" + value + "))"
+			case "string":
+				code = "appendApiBinpackString(buf, " + value + ")"
+			case "bool":
+				code = "appendApiBinpackBool(buf, " + value + ")"
+			default:
+				log.Fatalf("binpack: %s.%s: unsupported type %s", name, ident.Name, fieldType)
+			}
+			data.Fields = append(data.Fields, binpackField{Name: ident.Name, Append: code})
+		}
+	}
+	return data
+}
+
+var (
+	acceptTpl = template.Must(template.New("acceptTpl").Parse(`
+// apiMediaRange - элемент заголовка Accept
+type apiMediaRange struct {
+	Type string
+	Q    float64
+}
+
+// parseApiAccept разбирает Accept в порядке следования, q по-умолчанию 1
+func parseApiAccept(accept string) []apiMediaRange {
+	var ranges []apiMediaRange
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(mediaRange, ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		if mediaType == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if key == "q" {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		ranges = append(ranges, apiMediaRange{Type: mediaType, Q: q})
+	}
+	return ranges
+}
+
+func apiMediaMatch(mediaRange string, types []string) bool {
+	for _, typ := range types {
+		switch {
+		case mediaRange == typ, mediaRange == "*/*":
+			return true
+		case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(typ, mediaRange[:len(mediaRange)-1]):
+			return true
+		}
+	}
+	return false
+}
+`))
+
+	encodersTpl = template.Must(template.New("encodersTpl").Funcs(funcs).Parse(`
+// apiEncoder - формат ответа, выбираемый по заголовку Accept
+type apiEncoder struct {
+	// Types - первый уходит в Content-Type, остальные - синонимы для Accept
+	Types  []string
+	Encode func(w io.Writer, resp map[string]interface{}) error
+}
+
+var apiJSONEncoder = apiEncoder{
+	Types: []string{"application/json"},
+	Encode: func(w io.Writer, resp map[string]interface{}) error {
+		return json.NewEncoder(w).Encode(resp)
+	},
+}
+
+// negotiateApiEncoder выбирает формат с наибольшим q из Accept, при равных q -
+// тот, что раньше в Accept. Если ничего не подошло - первый, т.е. json
+func negotiateApiEncoder(accept string, encoders []apiEncoder) apiEncoder {
+	best, bestQ := encoders[0], 0.0
+	for _, mediaRange := range parseApiAccept(accept) {
+		if mediaRange.Q <= bestQ {
+			continue
+		}
+		for _, enc := range encoders {
+			if apiMediaMatch(mediaRange.Type, enc.Types) {
+				best, bestQ = enc, mediaRange.Q
+				break
+			}
+		}
+	}
+	return best
+}
+
+func writeApiNegotiated(w http.ResponseWriter, r *http.Request, status int, resp map[string]interface{}, encoders []apiEncoder) {
+	enc := negotiateApiEncoder(r.Header.Get("Accept"), encoders)
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Content-Type", enc.Types[0])
+	w.WriteHeader(status)
+	enc.Encode(w, resp)
+}
+{{if .Codecs.msgpack}}
+var apiMsgpackEncoder = apiEncoder{
+	Types: []string{"application/msgpack", "application/x-msgpack"},
+	Encode: func(w io.Writer, resp map[string]interface{}) error {
+		_, err := w.Write(appendApiMsgpack(nil, reflect.ValueOf(resp)))
+		return err
+	},
+}
+
+// appendApiMsgpack - MessagePack без внешних зависимостей. Поля структур
+// называются по тегу json, ключи map сортируются, чтобы ответ был стабильным
+func appendApiMsgpack(buf []byte, v reflect.Value) []byte {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return append(buf, 0xc0)
+		}
+		return appendApiMsgpack(buf, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, 0xc3)
+		}
+		return append(buf, 0xc2)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := v.Int()
+		switch {
+		case n >= 0:
+			return appendApiMsgpackUint(buf, uint64(n))
+		case n >= -32:
+			return append(buf, byte(n))
+		case n >= math.MinInt8:
+			return append(buf, 0xd0, byte(n))
+		case n >= math.MinInt16:
+			return binary.BigEndian.AppendUint16(append(buf, 0xd1), uint16(n))
+		case n >= math.MinInt32:
+			return binary.BigEndian.AppendUint32(append(buf, 0xd2), uint32(n))
+		}
+		return binary.BigEndian.AppendUint64(append(buf, 0xd3), uint64(n))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendApiMsgpackUint(buf, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return binary.BigEndian.AppendUint64(append(buf, 0xcb), math.Float64bits(v.Float()))
+	case reflect.String:
+		return appendApiMsgpackString(buf, v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return append(buf, 0xc0)
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			buf = appendApiMsgpackLen(buf, v.Len(), 0, 0, 0xc4, 0xc5, 0xc6)
+			for i := 0; i < v.Len(); i++ {
+				buf = append(buf, byte(v.Index(i).Uint()))
+			}
+			return buf
+		}
+		buf = appendApiMsgpackLen(buf, v.Len(), 16, 0x90, 0, 0xdc, 0xdd)
+		for i := 0; i < v.Len(); i++ {
+			buf = appendApiMsgpack(buf, v.Index(i))
+		}
+		return buf
+	case reflect.Map:
+		if v.IsNil() {
+			return append(buf, 0xc0)
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+		buf = appendApiMsgpackLen(buf, len(keys), 16, 0x80, 0, 0xde, 0xdf)
+		for _, key := range keys {
+			buf = appendApiMsgpackString(buf, key.String())
+			buf = appendApiMsgpack(buf, v.MapIndex(key))
+		}
+		return buf
+	case reflect.Struct:
+		var names []string
+		var values []reflect.Value
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			names = append(names, name)
+			values = append(values, v.Field(i))
+		}
+		buf = appendApiMsgpackLen(buf, len(names), 16, 0x80, 0, 0xde, 0xdf)
+		for i, name := range names {
+			buf = appendApiMsgpackString(buf, name)
+			buf = appendApiMsgpack(buf, values[i])
+		}
+		return buf
+	}
+	return append(buf, 0xc0)
+}
+
+func appendApiMsgpackUint(buf []byte, n uint64) []byte {
+	switch {
+	case n <= math.MaxInt8:
+		return append(buf, byte(n))
+	case n <= math.MaxUint8:
+		return append(buf, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, 0xcd), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, 0xce), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, 0xcf), n)
+}
+
+func appendApiMsgpackString(buf []byte, s string) []byte {
+	return append(appendApiMsgpackLen(buf, len(s), 32, 0xa0, 0xd9, 0xda, 0xdb), s...)
+}
+
+// appendApiMsgpackLen пишет заголовок с длиной: короткая форма fix|n, если
+// n < fixLimit, иначе маркер h8/h16/h32 и длина в 1, 2 или 4 байта.
+// fixLimit = 0 или h8 = 0 - у формата нет такой формы
+func appendApiMsgpackLen(buf []byte, n, fixLimit int, fix, h8, h16, h32 byte) []byte {
+	switch {
+	case n < fixLimit:
+		return append(buf, fix|byte(n))
+	case h8 != 0 && n <= math.MaxUint8:
+		return append(buf, h8, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, h16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(buf, h32), uint32(n))
+}
+{{end}}
+{{- if .Codecs.binpack}}
+type apiBinpacker interface {
+	AppendBinpack(buf []byte) []byte
+}
+
+// apiBinpackEncoder - формат из example/gen: строка ошибки, затем поля
+// результата. int - uint32, строки - uint32 длина + байты, little endian.
+// Список - uint32 количество и элементы, за ними next_cursor, если он есть
+var apiBinpackEncoder = apiEncoder{
+	Types: []string{"application/x-binpack"},
+	Encode: func(w io.Writer, resp map[string]interface{}) error {
+		msg, _ := resp["error"].(string)
+		buf := appendApiBinpackString(nil, msg)
+		switch res := resp["response"].(type) {
+		case nil:
+		case apiBinpacker:
+			buf = res.AppendBinpack(buf)
+		default:
+			// список: uint32 количество, затем элементы
+			items := reflect.ValueOf(res)
+			if items.Kind() != reflect.Slice {
+				break
+			}
+			buf = binary.LittleEndian.AppendUint32(buf, uint32(items.Len()))
+			for i := 0; i < items.Len(); i++ {
+				item := items.Index(i)
+				if item.Kind() != reflect.Pointer {
+					item = item.Addr()
+				}
+				if packer, ok := item.Interface().(apiBinpacker); ok {
+					buf = packer.AppendBinpack(buf)
+				}
+			}
+		}
+		if cursor, ok := resp["next_cursor"].(string); ok {
+			buf = appendApiBinpackString(buf, cursor)
+		}
+		_, err := w.Write(buf)
+		return err
+	},
+}
+
+func appendApiBinpackString(buf []byte, s string) []byte {
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
+
+func appendApiBinpackBool(buf []byte, b bool) []byte {
+	if b {
+		return append(buf, 1)
+	}
+	return append(buf, 0)
+}
+{{end}}
+`))
+
+	negotiateTpl = template.Must(template.New("negotiateTpl").Funcs(funcs).Parse(`
+var {{.Service.Name}}Encoders = []apiEncoder{
+{{- range .Service.EncoderVars}}
+	{{.}},
+{{- end}}
+}
+
+// {{.Service.ResponseWriter}} - формат ответа {{.Service.Name}} выбирается по Accept
+func {{.Service.ResponseWriter}}(w http.ResponseWriter, r *http.Request, status int, resp map[string]interface{}) {
+	writeApiNegotiated(w, r, status, resp, {{.Service.Name}}Encoders)
+}
+{{if .Service.HasFastJSON}}
+// {{.Service.ResultWriter}} - если по Accept выбран json, успешный ответ пишется через AppendJSON
+func {{.Service.ResultWriter}}(w http.ResponseWriter, r *http.Request, res apiJSONAppender) {
+	if enc := negotiateApiEncoder(r.Header.Get("Accept"), {{.Service.Name}}Encoders); enc.Types[0] != apiJSONEncoder.Types[0] {
+		writeApiNegotiated(w, r, http.StatusOK, map[string]interface{}{"error": "", "response": res}, {{.Service.Name}}Encoders)
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+	writeApiJSONResult(w, r, res)
+}
+{{end}}
+{{- if ne .Service.Format "problem"}}
+func {{.Service.ErrorWriter}}(w http.ResponseWriter, r *http.Request, err error) {
+	{{.Service.ResponseWriter}}(w, r, apiErrorStatus(err), apiErrorEnvelope(err))
+}
+{{end}}`))
+
+	binpackTpl = template.Must(template.New("binpackTpl").Funcs(funcs).Parse(`
+// AppendBinpack дописывает {{.StructName}} в buf для ответа application/x-binpack
+func (in *{{.StructName}}) AppendBinpack(buf []byte) []byte {
+	if in == nil {
+		return buf
+	}
+{{- range .Fields}}
+	buf = {{.Append}} // {{.Name}}
+{{- end}}
+	return buf
+}
+`))
+)
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"text/template"
+)
+
+// checkETag - ETag берётся у результата, так что списки не подходят.
+// Метод ETag() string у типа результата проверит компилятор
+func checkETag(method *MethodMeta) {
+	if method.ETag && method.List {
+		log.Fatalf("%s.%s: etag is not supported for list results", method.ApiName, method.Name)
+	}
+}
+
+// HasETags - есть ли у структуры методы с "etag": true
+func (srv *ServiceMeta) HasETags() bool {
+	for _, method := range srv.Methods {
+		if method.ETag {
+			return true
+		}
+	}
+	return false
+}
+
+var etagTpl = template.Must(template.New("etagTpl").Funcs(funcs).Parse(`
+type apiIfMatchKey struct{}
+
+// withApiIfMatch кладёт If-Match запроса в контекст метода
+func withApiIfMatch(r *http.Request) context.Context {
+	if header := r.Header.Get("If-Match"); header != "" {
+		return context.WithValue(r.Context(), apiIfMatchKey{}, header)
+	}
+	return r.Context()
+}
+
+// checkApiIfMatch - метод с "etag": true зовёт его с текущим ETag ресурса
+// до того, как что-то менять. Без If-Match в запросе проверять нечего
+func checkApiIfMatch(ctx context.Context, etag string) error {
+	header, ok := ctx.Value(apiIfMatchKey{}).(string)
+	if !ok || apiETagMatch(header, etag, false) {
+		return nil
+	}
+	return {{.Errors.New "http.StatusPreconditionFailed" "precondition failed" "precondition_failed" "map[string]interface{}{\"etag\": etag}"}}
+}
+
+// apiETagMatch сравнивает etag со списком из If-Match / If-None-Match.
+// If-Match сравнивает строго (W/ не совпадает ни с чем), If-None-Match - слабо
+func apiETagMatch(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+			etag = strings.TrimPrefix(etag, "W/")
+		} else if strings.HasPrefix(tag, "W/") || strings.HasPrefix(etag, "W/") {
+			continue
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkApiPreconditions ставит ETag ответа и для GET/HEAD проверяет условия
+// запроса: If-Match не совпал - 412, If-None-Match совпал - 304 без тела.
+// Для остальных методов If-Match уже проверил сам метод через checkApiIfMatch.
+// false - ответ уже записан
+func checkApiPreconditions(w http.ResponseWriter, r *http.Request, etag string, writeErr apiErrorWriter) bool {
+	w.Header().Set("ETag", etag)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return true
+	}
+	if header := r.Header.Get("If-Match"); header != "" && !apiETagMatch(header, etag, false) {
+		writeErr(w, r, {{.Errors.New "http.StatusPreconditionFailed" "precondition failed" "precondition_failed" "map[string]interface{}{\"etag\": etag}"}})
+		return false
+	}
+	if header := r.Header.Get("If-None-Match"); header != "" && apiETagMatch(header, etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return false
+	}
+	return true
+}
+`))
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	// testPrincipal - кем сгенерированные тесты проходят auth
+	testPrincipal = "apigen-test"
+	testSecret    = "apigen-test-secret"
+)
+
+// TestCase - запрос из сгенерированного теста и ответ, который обещают обёртки
+type TestCase struct {
+	Name   string
+	Method string
+	Path   string
+	Params url.Values
+	XAuth  string
+	Cert   bool
+	// Status - выражение со статусом, "0" - параметры проходят проверку, не 400
+	Status string
+	Err    string
+	Code   string
+
+	// Applied - поле Params, в которое <Params>Validator должен положить Want
+	// из default. Validator - тип Params, PathValues - {wildcard} из url
+	Applied    string
+	Want       string
+	Validator  string
+	PathValues map[string]string
+}
+
+// ParamsLiteral - Params литералом url.Values
+func (tc TestCase) ParamsLiteral() string {
+	if len(tc.Params) == 0 {
+		return "nil"
+	}
+	var keys []string
+	for key := range tc.Params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		parts = append(parts, strconv.Quote(key)+": {"+strconv.Quote(tc.Params.Get(key))+"}")
+	}
+	return "url.Values{" + strings.Join(parts, ", ") + "}"
+}
+
+// TestService - сгенерированный тест одной структуры API
+type TestService struct {
+	*ServiceMeta
+	// New - выражение, создающее структуру: New<Api>(), New<Api>(секреты) или &<Api>{}
+	New string
+	// NewAuth - секреты уже переданы в New<Api>
+	NewAuth bool
+	Cases   []TestCase
+}
+
+// testsData - то, что нужно шаблону тестов
+type testsData struct {
+	Package   string
+	Principal string
+	Secret    string
+	MTLS      bool
+	Services  []TestService
+}
+
+// ErrField - где в ответе текст ошибки
+func (test TestService) ErrField() string {
+	if test.Format == formatProblem {
+		return "detail"
+	}
+	return "error"
+}
+
+// constructor - New<Api>() без аргументов или New<Api>(AuthSecrets), если
+// он есть в файле, иначе пустая структура: тесты проверяют обёртки, до
+// методов доходят редко. auth - секреты переданы в конструктор
+func constructor(node *ast.File, name string) (expr string, auth bool) {
+	for _, decl := range node.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil || fn.Name.Name != "New"+name {
+			continue
+		}
+		params := fn.Type.Params.List
+		switch {
+		case len(params) == 0:
+		case len(params) == 1 && len(params[0].Names) <= 1 && typeName(params[0].Type) == authSecrets:
+			auth = true
+		default:
+			continue
+		}
+		results := fn.Type.Results
+		if results != nil && len(results.List) == 1 {
+			if star, ok := results.List[0].Type.(*ast.StarExpr); ok && typeName(star.X) == name {
+				if auth {
+					return fmt.Sprintf("New%s(AuthSecrets{%q: %q})", name, testPrincipal, testSecret), true
+				}
+				return "New" + name + "()", false
+			}
+		}
+	}
+	return "&" + name + "{}", false
+}
+
+// hasErrorCode - код ошибки попадает в ответ, только если у ApiError есть ErrorCode()
+func hasErrorCode(node *ast.File, meta ErrorMeta) bool {
+	if !meta.HasCode {
+		return false
+	}
+	for _, decl := range node.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if ok && fn.Recv != nil && fn.Name.Name == "ErrorCode" && typeName(fn.Recv.List[0].Type) == "ApiError" {
+			return true
+		}
+	}
+	return false
+}
+
+// validValue - значение поля, которое проходит все его проверки, "" - поле
+// можно не передавать
+func validValue(field FieldMeta) string {
+	switch {
+	case field.Default != "":
+		return field.Default
+	case len(field.Enum) > 0:
+		return field.Enum[0]
+	case field.IsInt() && field.HasMin:
+		return strconv.Itoa(field.Min)
+	case field.IsInt() && field.HasMax && field.Max < 0:
+		return strconv.Itoa(field.Max)
+	case field.IsInt():
+		if field.Required {
+			return "1"
+		}
+		return ""
+	}
+	n := 0
+	if field.Required {
+		n = 1
+	}
+	if field.HasMin && field.Min > n {
+		n = field.Min
+	}
+	return strings.Repeat("a", n)
+}
+
+// outsideEnum - значение не из enum, "" - такого не подобрать
+func outsideEnum(field FieldMeta) string {
+	if !field.IsInt() {
+		// длиннее любого из значений, значит, ни с одним не совпадёт
+		return strings.Join(field.Enum, "") + "x"
+	}
+	top := 0
+	for i, value := range field.Enum {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return ""
+		}
+		if i == 0 || n > top {
+			top = n
+		}
+	}
+	return strconv.Itoa(top + 1)
+}
+
+// sharedURL - на URL метода висят и другие методы структуры
+func sharedURL(method *MethodMeta) bool {
+	for _, other := range method.Service.Methods {
+		if other != method && other.URL == method.URL {
+			return true
+		}
+	}
+	return false
+}
+
+// otherMethod - HTTP-метод, которого нет у URL метода
+func otherMethod(method *MethodMeta, mode string) string {
+	allow := method.Method
+	if mode == modeMux || sharedURL(method) {
+		for _, other := range method.Service.Methods {
+			// метод без "method" на том же URL примет любой запрос
+			if other.URL == method.URL && other.Method == "" {
+				return ""
+			}
+		}
+		allow = method.Service.AllowFor(method.URL)
+	}
+	for _, candidate := range []string{"DELETE", "PATCH", "PUT", "POST", "GET"} {
+		if !strings.Contains(", "+allow+", ", ", "+candidate+", ") {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// testCases - случаи для метода из меток и тегов apivalidator: параметры
+// без обязательных, за min/max и не из enum, значения по-умолчанию, чужой
+// HTTP-метод и запрос без auth
+func testCases(method *MethodMeta, mode string, codes bool) []TestCase {
+	valid := map[string]string{}
+	for _, field := range method.Fields {
+		valid[field.ParamName] = validValue(field)
+	}
+	status := map[int]string{
+		400: "http.StatusBadRequest",
+		403: "http.StatusForbidden",
+		405: "http.StatusMethodNotAllowed",
+		406: "http.StatusNotAcceptable",
+	}
+
+	// request - запрос с правильными параметрами, кроме values
+	request := func(name string, values map[string]*string) TestCase {
+		tc := TestCase{
+			Name:   method.Name + " " + name,
+			Method: method.Method,
+			Path:   method.URL,
+			Params: url.Values{},
+			Status: "0",
+		}
+		if tc.Method == "" {
+			tc.Method = "GET"
+		}
+		switch method.Auth {
+		case authHeader:
+			tc.XAuth = testSecret
+		case authMTLS:
+			tc.Cert = true
+		}
+		for _, field := range method.Fields {
+			value := valid[field.ParamName]
+			if override, ok := values[field.ParamName]; ok {
+				if override == nil {
+					continue
+				}
+				value = *override
+			}
+			if field.FromPath {
+				tc.Path = strings.Replace(tc.Path, "{"+field.ParamName+"}", url.PathEscape(value), 1)
+				tc.Path = strings.Replace(tc.Path, "{"+field.ParamName+"...}", url.PathEscape(value), 1)
+			} else if value != "" {
+				tc.Params.Set(field.ParamName, value)
+			}
+		}
+		tc.Path = strings.Replace(tc.Path, "{$}", "", 1)
+		return tc
+	}
+	fail := func(tc TestCase, code int, err, errCode string) TestCase {
+		tc.Status = status[code]
+		tc.Err = err
+		if codes {
+			tc.Code = errCode
+		}
+		return tc
+	}
+	set := func(param, value string) map[string]*string {
+		return map[string]*string{param: &value}
+	}
+
+	var cases []TestCase
+	if other := otherMethod(method, mode); method.Method != "" && other != "" {
+		tc := request("bad method", nil)
+		tc.Method = other
+		// 406 - от самой обёртки, 405 - от mux или switch по r.Method
+		code := 406
+		if mode == modeMux || sharedURL(method) {
+			code = 405
+		}
+		cases = append(cases, fail(tc, code, "bad method", "bad_method"))
+	}
+	if method.Auth != "" {
+		tc := request("without auth", nil)
+		tc.XAuth, tc.Cert = "", false
+		cases = append(cases, fail(tc, 403, "unauthorized", "unauthorized"))
+	}
+	if method.Auth == authHeader {
+		tc := request("wrong X-Auth", nil)
+		tc.XAuth = "wrong-" + tc.XAuth
+		cases = append(cases, fail(tc, 403, "unauthorized", "unauthorized"))
+	}
+
+	for _, field := range method.Fields {
+		param := field.ParamName
+		if field.Required && !field.FromPath {
+			cases = append(cases, fail(request(param+" missing", map[string]*string{param: nil}),
+				400, param+" must me not empty", "param_required"))
+		}
+		if field.IsInt() {
+			cases = append(cases, fail(request(param+" not int", set(param, "x")),
+				400, param+" must be int", "param_not_int"))
+		}
+		if len(field.Enum) > 0 {
+			if value := outsideEnum(field); value != "" {
+				cases = append(cases, fail(request(param+" not in enum", set(param, value)),
+					400, fmt.Sprintf("%s must be one of [%s]", param, field.EnumText()), "param_not_in_enum"))
+			}
+		}
+		// значение не из enum отказывает раньше min и max
+		if field.HasMin && len(field.Enum) == 0 {
+			value := strconv.Itoa(field.Min - 1)
+			if !field.IsInt() {
+				value = strings.Repeat("a", max(field.Min-1, 0))
+			}
+			// пустая строка - это "не передали": сработает required или default
+			if value != "" || (!field.Required && field.Default == "" && !field.FromPath) {
+				cases = append(cases, fail(request(param+" below min", set(param, value)),
+					400, fmt.Sprintf("%s must be >= %d", field.Subject(), field.Min), "param_below_min"))
+			}
+		}
+		if field.HasMax && len(field.Enum) == 0 {
+			value := strconv.Itoa(field.Max + 1)
+			if !field.IsInt() {
+				value = strings.Repeat("a", field.Max+1)
+			}
+			cases = append(cases, fail(request(param+" above max", set(param, value)),
+				400, fmt.Sprintf("%s must be <= %d", field.Subject(), field.Max), "param_above_max"))
+		}
+		if field.Default != "" && !field.Required && !field.FromPath {
+			tc := request(param+" default", map[string]*string{param: nil})
+			tc.Applied, tc.Validator = field.Name, method.ParamsName
+			tc.Want = strconv.Quote(field.Default)
+			if field.IsInt() {
+				tc.Want = field.Default
+			}
+			for _, other := range method.Fields {
+				if other.FromPath {
+					if tc.PathValues == nil {
+						tc.PathValues = map[string]string{}
+					}
+					tc.PathValues[other.ParamName] = valid[other.ParamName]
+				}
+			}
+			cases = append(cases, tc)
+		}
+	}
+	return cases
+}
+
+func generateTests(node *ast.File, base tpl) ([]byte, error) {
+	data := testsData{Package: node.Name.Name, Principal: testPrincipal, Secret: testSecret}
+	codes := hasErrorCode(node, base.Errors)
+	for _, srv := range base.Services {
+		test := TestService{ServiceMeta: srv}
+		test.New, test.NewAuth = constructor(node, srv.Name)
+		for _, method := range srv.Methods {
+			test.Cases = append(test.Cases, testCases(method, base.Mode, codes)...)
+		}
+		data.Services = append(data.Services, test)
+	}
+	data.MTLS = hasMTLS(base.Services)
+
+	var out bytes.Buffer
+	if err := testsTpl.Execute(&out, data); err != nil {
+		return nil, err
+	}
+	return format.Source(out.Bytes())
+}
+
+var testsTpl = template.Must(template.New("testsTpl").Funcs(funcs).Parse(`// Code generated by handlers_gen. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{- if .MTLS}}
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+{{- end}}
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// apiTestCase - запрос к обёртке и ответ, который она обещает по меткам
+// apigen:api и тегам apivalidator. status 0 - параметры проходят проверку
+type apiTestCase struct {
+	name   string
+	method string
+	path   string
+	params url.Values
+	xAuth  string
+	cert   bool
+	status int
+	err    string
+	code   string
+	// applied - для случаев с default: что валидатор положил в поле и что
+	// обещает тег
+	applied func(r *http.Request) (got, want interface{}, err error)
+}
+
+// runApiTestCases шлёт запросы cases, каждый в свой экземпляр из newApi: у
+// экземпляра свои корзины rate_limit. errField - где в ответе текст ошибки
+func runApiTestCases(t *testing.T, newApi func() http.Handler, errField string, cases []apiTestCase) {
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			newApi().ServeHTTP(w, newApiTestRequest(tc))
+
+			if tc.status == 0 {
+				if w.Code == http.StatusBadRequest {
+					t.Fatalf("expected params to pass validation, got 400: %s", w.Body)
+				}
+				if tc.applied != nil {
+					got, want, err := tc.applied(newApiTestRequest(tc))
+					if err != nil || got != want {
+						t.Errorf("expected default %v, got %v (%v)", want, got, err)
+					}
+				}
+				return
+			}
+			if w.Code != tc.status {
+				t.Fatalf("expected status %d, got %d: %s", tc.status, w.Code, w.Body)
+			}
+			var resp map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("cant unpack json: %v: %s", err, w.Body)
+			}
+			if resp[errField] != tc.err {
+				t.Errorf("expected %s %q, got %v", errField, tc.err, resp[errField])
+			}
+			if tc.code != "" && resp["code"] != tc.code {
+				t.Errorf("expected code %q, got %v", tc.code, resp["code"])
+			}
+		})
+	}
+}
+
+// newApiTestRequest - запрос случая tc: параметры в query, у POST, PUT и
+// PATCH - в теле формой
+func newApiTestRequest(tc apiTestCase) *http.Request {
+	var body io.Reader
+	target := tc.path
+	switch tc.method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		body = strings.NewReader(tc.params.Encode())
+	default:
+		if len(tc.params) > 0 {
+			target += "?" + tc.params.Encode()
+		}
+	}
+	r := httptest.NewRequest(tc.method, target, body)
+	if body != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	r.Header.Set("Accept", "application/json")
+	if tc.xAuth != "" {
+		r.Header.Set("X-Auth", tc.xAuth)
+	}
+{{- if .MTLS}}
+	if tc.cert {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: {{quote .Principal}}}}
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{ {cert} }}
+	}
+{{- end}}
+	return r
+}
+{{range .Services}}
+func Test{{.Name}}Generated(t *testing.T) {
+	newApi := func() http.Handler {
+		h := {{.New}}
+{{- if and .AuthField (not .NewAuth)}}
+		h.{{.AuthField}} = AuthSecrets{ {{- quote $.Principal}}: {{quote $.Secret -}} }
+{{- end}}
+		return h
+	}
+	runApiTestCases(t, newApi, {{quote .ErrField}}, []apiTestCase{
+{{- range .Cases}}
+		{name: {{quote .Name}}, method: {{quote .Method}}, path: {{quote .Path}}
+		{{- if .Params}}, params: {{.ParamsLiteral}}{{end}}
+		{{- if .XAuth}}, xAuth: {{quote .XAuth}}{{end}}
+		{{- if .Cert}}, cert: true{{end}}
+		{{- if ne .Status "0"}}, status: {{.Status}}, err: {{quote .Err}}{{end}}
+		{{- if .Code}}, code: {{quote .Code}}{{end}}
+		{{- if .Applied}}, applied: func(r *http.Request) (interface{}, interface{}, error) {
+{{- range $name, $value := .PathValues}}
+			r.SetPathValue({{quote $name}}, {{quote $value}})
+{{- end}}
+			in, err := {{.Validator}}Validator(r)
+			return in.{{.Applied}}, {{.Want}}, err
+		}{{end}}},
+{{- end}}
+	})
+}
+{{end}}`))
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"go/ast"
+	"hash"
+	"log"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// generatorVersion - версия handlers_gen, её отдаёт /version
+const generatorVersion = "1.0.0"
+
+// HealthRoute - служебный маршрут "health" и его обработчик
+type HealthRoute struct {
+	URL     string
+	Handler string
+}
+
+// checkHealth проверяет префикс "health", ищет у структуры метод Ready
+// и считает хеш её меток
+func checkHealth(node *ast.File, srv *ServiceMeta) {
+	if srv.Health == "" {
+		return
+	}
+	if !strings.HasPrefix(srv.Health, "/") || !strings.HasSuffix(srv.Health, "/") {
+		log.Fatalf("%s: health %q must start and end with /", srv.Name, srv.Health)
+	}
+	for _, route := range srv.HealthRoutes() {
+		for _, method := range srv.Methods {
+			if method.URL == route.URL {
+				log.Fatalf("%s.%s: url %s is taken by health", srv.Name, method.Name, method.URL)
+			}
+		}
+	}
+
+	sum := sha256.New()
+	for _, decl := range node.Decls {
+		switch d := decl.(type) {
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				if ts, ok := spec.(*ast.TypeSpec); ok && ts.Name.Name == srv.Name {
+					writeAnnotations(sum, ts.Doc)
+					if len(d.Specs) == 1 {
+						writeAnnotations(sum, d.Doc)
+					}
+				}
+			}
+		case *ast.FuncDecl:
+			if d.Recv == nil || typeName(d.Recv.List[0].Type) != srv.Name {
+				continue
+			}
+			writeAnnotations(sum, d.Doc)
+			if d.Name.Name != "Ready" {
+				continue
+			}
+			params, results := d.Type.Params.List, d.Type.Results
+			if len(params) != 1 || len(params[0].Names) > 1 || typeName(params[0].Type) != "context.Context" ||
+				results == nil || len(results.List) != 1 || typeName(results.List[0].Type) != "error" {
+				log.Fatalf("%s.Ready: expected Ready(ctx context.Context) error", srv.Name)
+			}
+			srv.HasReady = true
+		}
+	}
+	srv.AnnotationsHash = hex.EncodeToString(sum.Sum(nil))
+}
+
+func writeAnnotations(sum hash.Hash, doc *ast.CommentGroup) {
+	if doc == nil {
+		return
+	}
+	for _, comment := range doc.List {
+		if strings.HasPrefix(comment.Text, apigenPrefix) {
+			sum.Write([]byte(strings.TrimPrefix(comment.Text, apigenPrefix) + "\n"))
+		}
+	}
+}
+
+// HealthRoutes - /healthz, /readyz и /version под префиксом "health"
+func (srv *ServiceMeta) HealthRoutes() []HealthRoute {
+	if srv.Health == "" {
+		return nil
+	}
+	ready := "nil"
+	if srv.HasReady {
+		ready = "h.Ready"
+	}
+	return []HealthRoute{
+		{srv.Health + "healthz", "http.HandlerFunc(apiHealthz)"},
+		{srv.Health + "readyz", "apiReadyz(" + ready + ")"},
+		{srv.Health + "version", "apiVersion(" + strconv.Quote(srv.AnnotationsHash) + ")"},
+	}
+}
+
+// Version - версия генератора для шаблона
+func (t tpl) Version() string {
+	return generatorVersion
+}
+
+func hasHealth(services []*ServiceMeta) bool {
+	for _, srv := range services {
+		if srv.Health != "" {
+			return true
+		}
+	}
+	return false
+}
+
+var healthTpl = template.Must(template.New("healthTpl").Funcs(funcs).Parse(`
+// apiGeneratorVersion - версия handlers_gen, которым сгенерирован файл
+const apiGeneratorVersion = {{quote .Version}}
+
+// apiHealthOnly - служебные маршруты отвечают только на GET и HEAD,
+// на остальное - 405 bad_method, как методы API
+func apiHealthOnly(next http.Handler, writeErr apiErrorWriter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeErr(w, r, {{.Errors.New "http.StatusMethodNotAllowed" "bad method" "bad_method" ""}})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiHealthz - процесс жив и отвечает
+func apiHealthz(w http.ResponseWriter, r *http.Request) {
+	writeApiJSON(w, r, http.StatusOK, map[string]interface{}{"status": "ok"})
+}
+
+// apiReadyz - готов ли API к запросам: ready - метод Ready структуры,
+// nil - готов всегда. Не готов - 503 с текстом ошибки
+func apiReadyz(ready func(ctx context.Context) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ready != nil {
+			if err := ready(r.Context()); err != nil {
+				writeApiJSON(w, r, http.StatusServiceUnavailable, map[string]interface{}{"status": "unavailable", "error": err.Error()})
+				return
+			}
+		}
+		writeApiJSON(w, r, http.StatusOK, map[string]interface{}{"status": "ready"})
+	})
+}
+
+// apiVersion - версия генератора и sha256 меток apigen:api, из которых собраны обёртки
+func apiVersion(annotations string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeApiJSON(w, r, http.StatusOK, map[string]interface{}{"generator": apiGeneratorVersion, "annotations": annotations})
+	})
+}
+`))
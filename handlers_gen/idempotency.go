@@ -0,0 +1,212 @@
+package main
+
+import (
+	"log"
+	"text/template"
+)
+
+const idempotencyStore = "IdempotencyStore"
+
+// checkIdempotent - ответы "idempotent": true методов хранятся в поле типа
+// IdempotencyStore, без него повторять нечего
+func checkIdempotent(method *MethodMeta, srv *ServiceMeta) {
+	if method.Idempotent && srv.IdempotencyField == "" {
+		log.Fatalf("%s.%s: idempotent declared, but %s has no %s field", method.ApiName, method.Name, method.ApiName, idempotencyStore)
+	}
+}
+
+// HasIdempotent - есть ли у структуры методы с "idempotent": true
+func (srv *ServiceMeta) HasIdempotent() bool {
+	for _, method := range srv.Methods {
+		if method.Idempotent {
+			return true
+		}
+	}
+	return false
+}
+
+var idempotencyTpl = template.Must(template.New("idempotencyTpl").Funcs(funcs).Parse(`
+// ErrIdempotencyInProgress - запрос с этим Idempotency-Key ещё выполняется
+var ErrIdempotencyInProgress = errors.New("idempotency key in progress")
+
+// IdempotentResponse - первый ответ на запрос с Idempotency-Key
+type IdempotentResponse struct {
+	// Fingerprint - хеш метода, URL и тела запроса, повтор с тем же ключом
+	// и другим запросом - ошибка клиента
+	Fingerprint string
+	Status      int
+	Header      http.Header
+	Body        []byte
+}
+
+// IdempotencyStore - где хранятся ответы для повторов. Поле этого типа
+// в структуре API включает "idempotent": true, nil - ключи не учитываются.
+// Ключ хранилища - метод API, principal и Idempotency-Key: один и тот же
+// ключ у разных клиентов и разных методов не пересекается
+type IdempotencyStore interface {
+	// Begin занимает ключ и возвращает nil, nil. Если ответ по ключу уже
+	// есть - возвращает его, если запрос ещё выполняется - ErrIdempotencyInProgress
+	Begin(ctx context.Context, key string) (*IdempotentResponse, error)
+	// Finish сохраняет ответ, nil - освобождает ключ (паника, 5xx)
+	Finish(ctx context.Context, key string, resp *IdempotentResponse)
+}
+
+type apiIdempotencyEntry struct {
+	resp    *IdempotentResponse
+	expires time.Time
+}
+
+// MemoryIdempotencyStore хранит ответы в памяти ttl с момента ответа.
+// Ключ, занятый упавшим запросом, тоже освобождается через ttl
+type MemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	entries   map[string]*apiIdempotencyEntry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryIdempotencyStore(ttl time.Duration) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{
+		ttl:     ttl,
+		entries: map[string]*apiIdempotencyEntry{},
+		now:     time.Now,
+	}
+}
+
+func (st *MemoryIdempotencyStore) Begin(ctx context.Context, key string) (*IdempotentResponse, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := st.now()
+	// просроченные выметаем не чаще раза в ttl, чтобы Begin не был O(n)
+	if now.Sub(st.lastSweep) > st.ttl {
+		for k, entry := range st.entries {
+			if now.After(entry.expires) {
+				delete(st.entries, k)
+			}
+		}
+		st.lastSweep = now
+	}
+
+	if entry, ok := st.entries[key]; ok && !now.After(entry.expires) {
+		if entry.resp == nil {
+			return nil, ErrIdempotencyInProgress
+		}
+		return entry.resp, nil
+	}
+	st.entries[key] = &apiIdempotencyEntry{expires: now.Add(st.ttl)}
+	return nil, nil
+}
+
+func (st *MemoryIdempotencyStore) Finish(ctx context.Context, key string, resp *IdempotentResponse) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if resp == nil {
+		delete(st.entries, key)
+		return
+	}
+	st.entries[key] = &apiIdempotencyEntry{resp: resp, expires: st.now().Add(st.ttl)}
+}
+
+// apiIdempotencyRecorder пишет ответ клиенту и запоминает его для повторов
+type apiIdempotencyRecorder struct {
+	http.ResponseWriter
+	store       IdempotencyStore
+	ctx         context.Context
+	key         string
+	fingerprint string
+	status      int
+	body        bytes.Buffer
+}
+
+func (rec *apiIdempotencyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *apiIdempotencyRecorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(data)
+	return rec.ResponseWriter.Write(data)
+}
+
+func (rec *apiIdempotencyRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// beginApiIdempotent - если в запросе есть Idempotency-Key, занимает его и
+// возвращает writer, который запомнит ответ, или сразу отвечает сохранённым
+// (true - ответ уже записан). Без ключа или без хранилища - как обычно.
+// method - "Api.Method", principal - кто прошёл auth, пустой без auth
+func beginApiIdempotent(w http.ResponseWriter, r *http.Request, store IdempotencyStore, method, principal string, writeErr apiErrorWriter) (http.ResponseWriter, bool) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" || store == nil {
+		return w, false
+	}
+	// в заголовках и principal переводов строк не бывает
+	key = method + "\n" + principal + "\n" + key
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeErr(w, r, apiBodyError(err))
+		return w, true
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.New()
+	io.WriteString(sum, r.Method+" "+r.URL.RequestURI()+"\n")
+	sum.Write(body)
+	fingerprint := hex.EncodeToString(sum.Sum(nil))
+
+	saved, err := store.Begin(r.Context(), key)
+	switch {
+	case errors.Is(err, ErrIdempotencyInProgress):
+		writeErr(w, r, {{.Errors.New "http.StatusConflict" "request with this idempotency key is in progress" "idempotency_key_in_use" ""}})
+		return w, true
+	case err != nil:
+		writeErr(w, r, err)
+		return w, true
+	case saved == nil:
+		return &apiIdempotencyRecorder{ResponseWriter: w, store: store, ctx: r.Context(), key: key, fingerprint: fingerprint}, false
+	case saved.Fingerprint != fingerprint:
+		writeErr(w, r, {{.Errors.New "http.StatusUnprocessableEntity" "idempotency key reused with another request" "idempotency_key_reused" ""}})
+		return w, true
+	}
+
+	for name, values := range saved.Header {
+		// у повтора свой X-Request-Id, по нему ищут этот запрос в логах
+		if name == "X-Request-Id" {
+			continue
+		}
+		w.Header()[name] = values
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(saved.Status)
+	w.Write(saved.Body)
+	return w, true
+}
+
+// finishApiIdempotent сохраняет ответ, записанный через beginApiIdempotent.
+// 5xx и паники не сохраняются - ключ освобождается для нового запроса
+func finishApiIdempotent(w http.ResponseWriter) {
+	rec, ok := w.(*apiIdempotencyRecorder)
+	if !ok {
+		return
+	}
+	if rec.status == 0 || rec.status >= http.StatusInternalServerError {
+		rec.store.Finish(rec.ctx, rec.key, nil)
+		return
+	}
+	rec.store.Finish(rec.ctx, rec.key, &IdempotentResponse{
+		Fingerprint: rec.fingerprint,
+		Status:      rec.status,
+		Header:      rec.Header().Clone(),
+		Body:        rec.body.Bytes(),
+	})
+}
+`))
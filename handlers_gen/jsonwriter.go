@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+type jsonField struct {
+	Name string
+	// Key - `,"name":` уже в виде json, запятая впереди убирается у первого поля
+	Key       string
+	Append    string
+	OmitEmpty string
+}
+
+type jsonTplData struct {
+	StructName string
+	Fields     []jsonField
+}
+
+// jsonStruct раскладывает поля результата для AppendJSON. Если какое-то поле
+// нельзя записать без reflection (вложенные структуры, слайсы, float, опция
+// string) - возвращает false, и метод отдаётся через encoding/json как раньше
+func jsonStruct(name string, st *ast.StructType) (jsonTplData, bool) {
+	data := jsonTplData{StructName: name}
+	if st == nil {
+		return data, false
+	}
+	for _, field := range st.Fields.List {
+		var tag reflect.StructTag
+		if field.Tag != nil {
+			raw, _ := strconv.Unquote(field.Tag.Value)
+			tag = reflect.StructTag(raw)
+		}
+		jsonName, opts, hasOpts := strings.Cut(tag.Get("json"), ",")
+		if jsonName == "-" && !hasOpts {
+			continue
+		}
+		omitEmpty := false
+		for _, opt := range strings.Split(opts, ",") {
+			switch opt {
+			case "":
+			case "omitempty":
+				omitEmpty = true
+			default:
+				return data, false
+			}
+		}
+		if len(field.Names) == 0 {
+			return data, false
+		}
+
+		fieldType := typeName(field.Type)
+		if _, ok := field.Type.(*ast.Ident); !ok {
+			return data, false
+		}
+		for _, ident := range field.Names {
+			if !ast.IsExported(ident.Name) {
+				continue
+			}
+			key := jsonName
+			if key == "" {
+				key = ident.Name
+			}
+			quoted, _ := json.Marshal(key)
+
+			value := "in." + ident.Name
+			f := jsonField{Name: ident.Name, Key: strconv.Quote("," + string(quoted) + ":")}
+			switch fieldType {
+			case "string":
+				f.Append = "appendApiJSONString(buf, " + value + ")"
+				f.OmitEmpty = value + ` != ""`
+			case "bool":
+				f.Append = "strconv.AppendBool(buf, " + value + ")"
+				f.OmitEmpty = value
+			case "int", "int8", "int16", "int32", "int64":
+				f.Append = "strconv.AppendInt(buf, int64(" + value + "), 10)"
+				f.OmitEmpty = value + " != 0"
+			case "uint", "uint8", "uint16", "uint32", "uint64":
+				f.Append = "strconv.AppendUint(buf, uint64(" + value + "), 10)"
+				f.OmitEmpty = value + " != 0"
+			default:
+				return data, false
+			}
+			if !omitEmpty {
+				f.OmitEmpty = ""
+			}
+			data.Fields = append(data.Fields, f)
+		}
+	}
+	return data, true
+}
+
+// markFastJSON отмечает методы, результат которых умеет AppendJSON,
+// и возвращает такие типы для генерации
+func markFastJSON(services []*ServiceMeta, structs map[string]*ast.StructType) []jsonTplData {
+	results := map[string]jsonTplData{}
+	supported := map[string]bool{}
+	for _, srv := range services {
+		for _, method := range srv.Methods {
+			if method.List {
+				continue
+			}
+			name := method.ResultName
+			if _, seen := supported[name]; !seen {
+				data, ok := jsonStruct(name, structs[name])
+				supported[name] = ok
+				if ok {
+					results[name] = data
+				}
+			}
+			method.FastJSON = supported[name]
+		}
+	}
+
+	var names []string
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var result []jsonTplData
+	for _, name := range names {
+		result = append(result, results[name])
+	}
+	return result
+}
+
+// HasFastJSON - есть ли у структуры методы с AppendJSON
+func (srv *ServiceMeta) HasFastJSON() bool {
+	for _, method := range srv.Methods {
+		if method.FastJSON {
+			return true
+		}
+	}
+	return false
+}
+
+// ResultWriter - чем пишется успешный ответ метода с AppendJSON
+func (srv *ServiceMeta) ResultWriter() string {
+	if srv.Negotiate() {
+		return "write" + srv.Name + "Result"
+	}
+	return "writeApiJSONResult"
+}
+
+var (
+	jsonHelpersTpl = template.Must(template.New("jsonHelpersTpl").Funcs(funcs).Parse(`
+// apiJSONAppender - результаты, для которых сгенерирован AppendJSON
+type apiJSONAppender interface {
+	AppendJSON(buf []byte) []byte
+}
+
+var apiJSONBufs = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 512)
+		return &buf
+	},
+}
+
+// общий слайс для заголовка, чтобы Header().Set не аллоцировал на каждый ответ:
+// свой []string{...} попадает в map заголовков и уходит в кучу. Слайс один на
+// все ответы, поэтому менять его на месте нельзя - ни здесь, ни в middleware:
+// только заменять целиком через Header().Set
+var apiJSONContentType = []string{"application/json"}
+
+// writeApiJSONResult пишет {"error":"","response":...} без map и reflection -
+// байт в байт то же, что json.NewEncoder(w).Encode(map[string]interface{}{...})
+func writeApiJSONResult(w http.ResponseWriter, r *http.Request, res apiJSONAppender) {
+	bufp := apiJSONBufs.Get().(*[]byte)
+	buf := append((*bufp)[:0], "{\"error\":\"\",\"response\":"...)
+	buf = res.AppendJSON(buf)
+	buf = append(buf, "}\n"...)
+
+	w.Header()["Content-Type"] = apiJSONContentType
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+
+	*bufp = buf
+	apiJSONBufs.Put(bufp)
+}
+
+const apiJSONHex = "0123456789abcdef"
+
+// appendApiJSONString экранирует строку так же, как encoding/json
+// (включая HTML-символы, U+2028/U+2029 и битый utf-8)
+func appendApiJSONString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			buf = append(buf, s[start:i]...)
+			switch b {
+			case '\\', '"':
+				buf = append(buf, '\\', b)
+			case '\b':
+				buf = append(buf, '\\', 'b')
+			case '\f':
+				buf = append(buf, '\\', 'f')
+			case '\n':
+				buf = append(buf, '\\', 'n')
+			case '\r':
+				buf = append(buf, '\\', 'r')
+			case '\t':
+				buf = append(buf, '\\', 't')
+			default:
+				buf = append(buf, '\\', 'u', '0', '0', apiJSONHex[b>>4], apiJSONHex[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		c, size := utf8.DecodeRuneInString(s[i:])
+		if c == utf8.RuneError && size == 1 {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if c == '\u2028' || c == '\u2029' {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, '\\', 'u', '2', '0', '2', apiJSONHex[c&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf = append(buf, s[start:]...)
+	return append(buf, '"')
+}
+`))
+
+	jsonStructTpl = template.Must(template.New("jsonStructTpl").Funcs(funcs).Parse(`
+// AppendJSON дописывает {{.StructName}} в buf так же, как json.Marshal, но без reflection
+func (in *{{.StructName}}) AppendJSON(buf []byte) []byte {
+	if in == nil {
+		return append(buf, "null"...)
+	}
+	start := len(buf)
+{{- range .Fields}}
+{{- if .OmitEmpty}}
+	if {{.OmitEmpty}} {
+		buf = append(buf, {{.Key}}...)
+		buf = {{.Append}}
+	}
+{{- else}}
+	buf = append(buf, {{.Key}}...)
+	buf = {{.Append}}
+{{- end}}
+{{- end}}
+	if len(buf) == start {
+		return append(buf, "{}"...)
+	}
+	// у первого поля вместо запятой открываем объект
+	buf[start] = '{'
+	return append(buf, '}')
+}
+`))
+)
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"KB", 1 << 10},
+	{"MB", 1 << 20},
+	{"GB", 1 << 30},
+	{"B", 1},
+}
+
+// parseMaxBody разбирает "max_body": "64KB" (B, KB, MB, GB - степени 1024)
+func parseMaxBody(method *MethodMeta) {
+	if method.MaxBody == "" {
+		return
+	}
+	raw := strings.ToUpper(strings.TrimSpace(method.MaxBody))
+	unit := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(raw, u.suffix) {
+			raw, unit = strings.TrimSpace(strings.TrimSuffix(raw, u.suffix)), u.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || n <= 0 {
+		log.Fatalf("%s.%s: bad max_body %q, expected like \"64KB\" or \"1MB\"", method.ApiName, method.Name, method.MaxBody)
+	}
+	method.MaxBodyBytes = n * unit
+}
+
+// AllowedParams - []string{...} параметров, которые strict пропускает
+func (method *MethodMeta) AllowedParams() string {
+	var names []string
+	for _, field := range method.Fields {
+		if !field.FromPath {
+			names = append(names, strconv.Quote(field.ParamName))
+		}
+	}
+	return "[]string{" + strings.Join(names, ", ") + "}"
+}
+
+// ParsesForm - обёртке надо разобрать форму заранее, чтобы не потерять ошибку:
+// r.FormValue молча отдаёт пустую строку, если тело не прочиталось
+func (method *MethodMeta) ParsesForm() bool {
+	return method.MaxBodyBytes > 0 || method.Strict
+}
+
+func needsBodyHelpers(services []*ServiceMeta) bool {
+	for _, srv := range services {
+		for _, method := range srv.Methods {
+			if method.ParsesForm() || method.Idempotent {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var bodyTpl = template.Must(template.New("bodyTpl").Funcs(funcs).Parse(`
+// apiBodyError - тело не прочиталось: больше max_body - 413, иначе 400
+func apiBodyError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return {{.Errors.New "http.StatusRequestEntityTooLarge" "request body too large" "body_too_large" "map[string]interface{}{\"limit\": tooLarge.Limit}"}}
+	}
+	return {{.Errors.New "http.StatusBadRequest" "bad request body" "bad_body" ""}}
+}
+
+// parseApiForm разбирает query и тело формы. allowed != nil - строгий режим:
+// параметр, которого нет в Params, - ошибка, а не молча пропущенная опечатка
+func parseApiForm(r *http.Request, allowed []string) error {
+	if err := r.ParseForm(); err != nil {
+		return apiBodyError(err)
+	}
+	if allowed == nil {
+		return nil
+	}
+	names := make([]string, 0, len(r.Form))
+	for name := range r.Form {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		known := false
+		for _, param := range allowed {
+			known = known || param == name
+		}
+		if !known {
+			return {{.Errors.New "http.StatusBadRequest" "unknown param" "unknown_param" "map[string]interface{}{\"param\": name}"}}
+		}
+	}
+	return nil
+}
+`))
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"go/ast"
+	"go/types"
+	"log"
+	"text/template"
+)
+
+// resultMeta разбирает результаты метода:
+//   - (*R, error) - один объект, как раньше
+//   - ([]R, error) и ([]R, string, error) - список, вторым идёт next_cursor
+//   - (<-chan R, error) - список, который можно отдавать потоком NDJSON
+func resultMeta(method *MethodMeta, results *ast.FieldList) {
+	if results == nil || len(results.List) < 2 || len(results.List) > 3 {
+		log.Fatalf("%s.%s: expected (result, error) or ([]item, next_cursor string, error) results", method.ApiName, method.Name)
+	}
+	result := results.List[0].Type
+	method.ResultType = types.ExprString(result)
+	method.ResultName = typeName(result)
+
+	switch t := result.(type) {
+	case *ast.ArrayType:
+		if t.Len != nil {
+			log.Fatalf("%s.%s: arrays are not supported, use a slice", method.ApiName, method.Name)
+		}
+		method.List = true
+		method.ItemType = types.ExprString(t.Elt)
+		method.ResultName = typeName(t.Elt)
+	case *ast.ChanType:
+		if t.Dir == ast.SEND {
+			log.Fatalf("%s.%s: result channel must be readable", method.ApiName, method.Name)
+		}
+		method.List = true
+		method.Chan = true
+		method.ItemType = types.ExprString(t.Value)
+		method.ResultName = typeName(t.Value)
+	}
+
+	if len(results.List) == 3 {
+		if !method.List || method.Chan || types.ExprString(results.List[1].Type) != "string" {
+			log.Fatalf("%s.%s: only ([]item, next_cursor string, error) may have 3 results", method.ApiName, method.Name)
+		}
+		method.Cursor = true
+	}
+}
+
+// checkCursor - у метода с next_cursor должен быть строковый параметр cursor,
+// иначе клиенту некуда передать курсор следующей страницы
+func checkCursor(method *MethodMeta) {
+	if !method.Cursor {
+		return
+	}
+	for _, field := range method.Fields {
+		if field.ParamName == "cursor" && !field.IsInt() {
+			return
+		}
+	}
+	log.Fatalf("%s.%s: paginated method needs a string Cursor field in %s", method.ApiName, method.Name, method.ParamsName)
+}
+
+// HasLists - есть ли у структуры методы, возвращающие списки
+func (srv *ServiceMeta) HasLists() bool {
+	for _, method := range srv.Methods {
+		if method.List {
+			return true
+		}
+	}
+	return false
+}
+
+var streamTpl = template.Must(template.New("streamTpl").Funcs(funcs).Parse(`
+// apiWantsNDJSON - клиент просит список потоком, по объекту на строку:
+// у application/x-ndjson в Accept наибольший q, как в negotiateApiEncoder.
+// */* и q=0 поток не включают
+func apiWantsNDJSON(r *http.Request) bool {
+	ndjson, bestQ := false, 0.0
+	for _, mediaRange := range parseApiAccept(r.Header.Get("Accept")) {
+		if mediaRange.Q <= bestQ {
+			continue
+		}
+		ndjson, bestQ = mediaRange.Type == "application/x-ndjson", mediaRange.Q
+	}
+	return ndjson
+}
+
+// writeApiNDJSON пишет элементы списка по одному на строку
+func writeApiNDJSON[T any](w http.ResponseWriter, items []T) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	for _, item := range items {
+		if enc.Encode(item) != nil {
+			return
+		}
+	}
+}
+
+// apiStreamWriteTimeout - сколько ждать, пока клиент примет элемент потока.
+// WriteTimeout сервера считается от начала запроса и оборвал бы долгий поток,
+// поэтому перед каждым элементом дедлайн записи сдвигается на это время
+const apiStreamWriteTimeout = 10 * time.Second
+
+// streamApiNDJSON пишет элементы из канала по мере поступления, сбрасывая
+// каждый клиенту. Если клиент отвалился - перестаёт читать: метод должен
+// сам закрыть канал по ctx.Done(), контекст запроса к этому моменту отменён
+func streamApiNDJSON[T any](w http.ResponseWriter, items <-chan T) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	rc := http.NewResponseController(w)
+	// ошибка - writer без дедлайнов (httptest), ограничивать нечего
+	rc.SetWriteDeadline(time.Now().Add(apiStreamWriteTimeout))
+	w.WriteHeader(http.StatusOK)
+	// заголовки уходят сразу, не дожидаясь первого элемента
+	rc.Flush()
+	enc := json.NewEncoder(w)
+	for item := range items {
+		rc.SetWriteDeadline(time.Now().Add(apiStreamWriteTimeout))
+		if enc.Encode(item) != nil || rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+// collectApiChan вычитывает канал целиком для ответа в конверте
+func collectApiChan[T any](items <-chan T) []T {
+	result := []T{}
+	for item := range items {
+		result = append(result, item)
+	}
+	return result
+}
+`))
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"text/template"
+)
+
+func hasMetrics(services []*ServiceMeta) bool {
+	for _, srv := range services {
+		if srv.Metrics {
+			return true
+		}
+	}
+	return false
+}
+
+var metricsTpl = template.Must(template.New("metricsTpl").Funcs(funcs).Parse(`
+// apiLatencyBuckets - границы гистограммы длительности запросов, секунды
+var apiLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type apiEndpointKey struct {
+	api, endpoint string
+}
+
+type apiErrorKey struct {
+	status int
+	code   string
+}
+
+type apiEndpointMetrics struct {
+	requests map[int]uint64
+	errors   map[apiErrorKey]uint64
+	// buckets[i] - запросы не дольше apiLatencyBuckets[i], без накопления
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// apiMetrics - счётчики всех структур с "metrics": true, общие на процесс
+var apiMetrics = struct {
+	mu        sync.Mutex
+	endpoints map[apiEndpointKey]*apiEndpointMetrics
+}{endpoints: map[apiEndpointKey]*apiEndpointMetrics{}}
+
+// observeApiRequest вызывается через defer в обёртках: запрос, ошибка
+// (4xx и 5xx по статусу и коду ApiError) и длительность
+func observeApiRequest(rec *apiRecorder, r *http.Request, api, endpoint string, start time.Time) {
+	status := rec.finalStatus(r)
+	seconds := time.Since(start).Seconds()
+
+	apiMetrics.mu.Lock()
+	defer apiMetrics.mu.Unlock()
+
+	key := apiEndpointKey{api, endpoint}
+	m, ok := apiMetrics.endpoints[key]
+	if !ok {
+		m = &apiEndpointMetrics{
+			requests: map[int]uint64{},
+			errors:   map[apiErrorKey]uint64{},
+			buckets:  make([]uint64, len(apiLatencyBuckets)),
+		}
+		apiMetrics.endpoints[key] = m
+	}
+	m.requests[status]++
+	if status >= http.StatusBadRequest {
+		m.errors[apiErrorKey{status, rec.code}]++
+	}
+	for i, le := range apiLatencyBuckets {
+		if seconds <= le {
+			m.buckets[i]++
+			break
+		}
+	}
+	m.sum += seconds
+	m.count++
+}
+
+// apiLabels - {name="value",...} с экранированием из text exposition format
+func apiLabels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(pairs[i+1])
+		b.WriteString(pairs[i] + "=\"" + value + "\"")
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func apiFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// MetricsHandler отдаёт счётчики обёрток в текстовом формате Prometheus
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiMetrics.mu.Lock()
+		keys := make([]apiEndpointKey, 0, len(apiMetrics.endpoints))
+		for key := range apiMetrics.endpoints {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].api != keys[j].api {
+				return keys[i].api < keys[j].api
+			}
+			return keys[i].endpoint < keys[j].endpoint
+		})
+
+		var requests, errs, latency strings.Builder
+		for _, key := range keys {
+			m := apiMetrics.endpoints[key]
+
+			statuses := make([]int, 0, len(m.requests))
+			for status := range m.requests {
+				statuses = append(statuses, status)
+			}
+			sort.Ints(statuses)
+			for _, status := range statuses {
+				fmt.Fprintf(&requests, "apigen_requests_total%s %d\n",
+					apiLabels("api", key.api, "endpoint", key.endpoint, "status", strconv.Itoa(status)), m.requests[status])
+			}
+
+			errKeys := make([]apiErrorKey, 0, len(m.errors))
+			for errKey := range m.errors {
+				errKeys = append(errKeys, errKey)
+			}
+			sort.Slice(errKeys, func(i, j int) bool {
+				if errKeys[i].status != errKeys[j].status {
+					return errKeys[i].status < errKeys[j].status
+				}
+				return errKeys[i].code < errKeys[j].code
+			})
+			for _, errKey := range errKeys {
+				fmt.Fprintf(&errs, "apigen_errors_total%s %d\n",
+					apiLabels("api", key.api, "endpoint", key.endpoint, "status", strconv.Itoa(errKey.status), "code", errKey.code), m.errors[errKey])
+			}
+
+			var cumulative uint64
+			for i, le := range apiLatencyBuckets {
+				cumulative += m.buckets[i]
+				fmt.Fprintf(&latency, "apigen_request_duration_seconds_bucket%s %d\n",
+					apiLabels("api", key.api, "endpoint", key.endpoint, "le", apiFloat(le)), cumulative)
+			}
+			fmt.Fprintf(&latency, "apigen_request_duration_seconds_bucket%s %d\n",
+				apiLabels("api", key.api, "endpoint", key.endpoint, "le", "+Inf"), m.count)
+			labels := apiLabels("api", key.api, "endpoint", key.endpoint)
+			fmt.Fprintf(&latency, "apigen_request_duration_seconds_sum%s %s\n", labels, apiFloat(m.sum))
+			fmt.Fprintf(&latency, "apigen_request_duration_seconds_count%s %d\n", labels, m.count)
+		}
+		apiMetrics.mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fmt.Fprint(w, "# HELP apigen_requests_total Requests by status.\n# TYPE apigen_requests_total counter\n", requests.String())
+		fmt.Fprint(w, "# HELP apigen_errors_total Error responses by status and ApiError code.\n# TYPE apigen_errors_total counter\n", errs.String())
+		fmt.Fprint(w, "# HELP apigen_request_duration_seconds Request latency.\n# TYPE apigen_request_duration_seconds histogram\n", latency.String())
+	})
+}
+`))
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	rateLimiter = "RateLimiter"
+	// тип поля с лимитами вместо указанных в метках
+	rateLimits = "RateLimits"
+)
+
+// parseRateLimit разбирает "rate_limit": "10/s" (s, m, h) и burst.
+// burst по-умолчанию - число из rate_limit
+func parseRateLimit(method *MethodMeta) {
+	if method.RateLimit == "" {
+		if method.Burst != 0 {
+			log.Fatalf("%s.%s: burst without rate_limit", method.ApiName, method.Name)
+		}
+		return
+	}
+	count, unit, ok := strings.Cut(method.RateLimit, "/")
+	n, err := strconv.Atoi(count)
+	per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[unit]
+	if !ok || err != nil || n <= 0 || per == 0 || method.Burst < 0 {
+		log.Fatalf("%s.%s: bad rate_limit %q, expected like \"10/s\", \"100/m\" or \"1000/h\"", method.ApiName, method.Name, method.RateLimit)
+	}
+	method.Rate = float64(n) / per.Seconds()
+	if method.Burst == 0 {
+		method.Burst = n
+	}
+}
+
+// checkRateLimit - корзины "rate_limit" методов живут в поле типа RateLimiter
+// самой структуры: общий на процесс лимитер делили бы все её экземпляры
+func checkRateLimit(method *MethodMeta, srv *ServiceMeta) {
+	if method.RateLimit != "" && srv.LimiterField == "" {
+		log.Fatalf("%s.%s: rate_limit declared, but %s has no %s field", method.ApiName, method.Name, method.ApiName, rateLimiter)
+	}
+}
+
+// RateLimitLiteral - {Rate: ..., Burst: ...} для таблицы apiRateLimits
+func (method *MethodMeta) RateLimitLiteral() string {
+	return "{Rate: " + strconv.FormatFloat(method.Rate, 'g', -1, 64) + ", Burst: " + strconv.Itoa(method.Burst) + "}"
+}
+
+// RateLimitKey - у каждого метода свои корзины и своя строка в apiRateLimits
+func (method *MethodMeta) RateLimitKey() string {
+	return strconv.Quote(method.ApiName + "." + method.Name)
+}
+
+// Limiter - поле типа RateLimiter, в котором считаются лимиты
+func (srv *ServiceMeta) Limiter() string {
+	return "h." + srv.LimiterField
+}
+
+// RateLimits - поле типа RateLimits или nil, тогда лимиты из меток
+func (srv *ServiceMeta) RateLimits() string {
+	if srv.LimitsField == "" {
+		return "nil"
+	}
+	return "h." + srv.LimitsField
+}
+
+func hasRateLimits(services []*ServiceMeta) bool {
+	for _, srv := range services {
+		for _, method := range srv.Methods {
+			if method.RateLimit != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var principalTpl = template.Must(template.New("principalTpl").Funcs(funcs).Parse(`
+type apiPrincipalKey struct{}
+
+// WithPrincipal - middleware аутентификации кладёт сюда, кто делает запрос.
+// Лимиты считаются по нему, а без него - по IP
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, apiPrincipalKey{}, principal)
+}
+
+func PrincipalFromContext(ctx context.Context) (string, bool) {
+	principal, ok := ctx.Value(apiPrincipalKey{}).(string)
+	return principal, ok && principal != ""
+}
+
+// apiClientKey - principal, если он известен, иначе IP без порта.
+// X-Forwarded-For не смотрим: за прокси IP надо доставать в middleware
+func apiClientKey(r *http.Request) string {
+	if principal, ok := PrincipalFromContext(r.Context()); ok {
+		return "principal:" + principal
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+`))
+
+var rateLimitTpl = template.Must(template.New("rateLimitTpl").Funcs(funcs).Parse(`
+// RateLimit - Rate запросов в секунду, не больше Burst подряд
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimiter решает, пропускать ли запрос с ключом key. Если нет - сколько
+// ждать до следующей попытки. Поле этого типа в структуре API включает
+// "rate_limit", nil - лимиты не считаются. Для нескольких копий сервиса -
+// лимитер в общем хранилище
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, limit RateLimit) (bool, time.Duration)
+}
+
+type apiBucket struct {
+	tokens float64
+	last   time.Time
+	limit  RateLimit
+}
+
+func (b *apiBucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+}
+
+// MemoryRateLimiter - token bucket на каждый ключ в памяти процесса
+type MemoryRateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*apiBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{buckets: map[string]*apiBucket{}, now: time.Now}
+}
+
+// apiRateLimits - лимиты методов из меток, "Api.Method" -> лимит
+var apiRateLimits = map[string]RateLimit{
+{{- range .Services}}
+{{- range .Methods}}
+{{- if .RateLimit}}
+	{{.RateLimitKey}}: {{.RateLimitLiteral}},
+{{- end}}
+{{- end}}
+{{- end}}
+}
+
+// RateLimits - лимиты методов вместо указанных в метках, "MyApi.Create" -> лимит,
+// например из файла настроек. Поле этого типа в структуре API, nil - как в метках
+type RateLimits map[string]RateLimit
+
+// Check - ошибка, если лимит задан методу без "rate_limit" в метке: у такого
+// метода лимит не включится
+func (limits RateLimits) Check() error {
+	for name, limit := range limits {
+		if _, ok := apiRateLimits[name]; !ok {
+			return fmt.Errorf("no rate_limit for %q in apigen:api annotations", name)
+		}
+		if limit.Rate <= 0 || limit.Burst < 1 {
+			return fmt.Errorf("%s: rate must be > 0 and burst >= 1, got %v", name, limit)
+		}
+	}
+	return nil
+}
+
+func (lim *MemoryRateLimiter) Allow(ctx context.Context, key string, limit RateLimit) (bool, time.Duration) {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+
+	now := lim.now()
+	// полные корзины ничем не отличаются от новых - раз в минуту выкидываем
+	if now.Sub(lim.lastSweep) > time.Minute {
+		for k, b := range lim.buckets {
+			if b.refill(now); b.tokens >= float64(b.limit.Burst) {
+				delete(lim.buckets, k)
+			}
+		}
+		lim.lastSweep = now
+	}
+
+	b, ok := lim.buckets[key]
+	if !ok {
+		b = &apiBucket{tokens: float64(limit.Burst), last: now}
+		lim.buckets[key] = b
+	}
+	b.limit = limit
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// allowApiRequest - false, если лимит метода исчерпан и 429 уже записан
+func allowApiRequest(w http.ResponseWriter, r *http.Request, limiter RateLimiter, limits RateLimits, method string, writeErr apiErrorWriter) bool {
+	if limiter == nil {
+		return true
+	}
+	limit, ok := limits[method]
+	if !ok {
+		limit = apiRateLimits[method]
+	}
+	ok, wait := limiter.Allow(r.Context(), method+" "+apiClientKey(r), limit)
+	if ok {
+		return true
+	}
+	retry := int(math.Ceil(wait.Seconds()))
+	if retry < 1 {
+		retry = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	writeErr(w, r, {{.Errors.New "http.StatusTooManyRequests" "too many requests" "rate_limited" "map[string]interface{}{\"retry_after\": retry}"}})
+	return false
+}
+`))
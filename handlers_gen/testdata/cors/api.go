@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+)
+
+type ApiError struct {
+	HTTPStatus int
+	Err        error
+}
+
+func (ae ApiError) Error() string {
+	return ae.Err.Error()
+}
+
+// apigen:api {"cors": {"origins": ["*"], "max_age": 60}}
+type ItemApi struct {
+	routes ApiRoutes
+}
+
+type ItemParams struct {
+	ID string
+}
+
+type Item struct {
+	ID string `json:"id"`
+}
+
+// apigen:api {"url": "/item/{id}", "method": "GET"}
+func (srv *ItemApi) Get(ctx context.Context, in ItemParams) (*Item, error) {
+	return &Item{ID: in.ID}, nil
+}
+
+// менять можно только из админки и с куками
+// apigen:api {"url": "/item/{id}", "method": "PUT", "cors": {"origins": ["https://admin.example.com"], "headers": ["Content-Type"], "credentials": true}}
+func (srv *ItemApi) Put(ctx context.Context, in ItemParams) (*Item, error) {
+	return &Item{ID: in.ID}, nil
+}
+
+// apigen:api {"url": "/ping"}
+func (srv *ItemApi) Ping(ctx context.Context, in ItemParams) (*Item, error) {
+	return &Item{ID: "pong"}, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	api := &ItemApi{}
+	cases := []struct {
+		name        string
+		path        string
+		origin      string
+		method      string
+		status      int
+		allowOrigin string
+		methods     string
+		credentials string
+	}{
+		{"public GET", "/item/1", "https://any.example.com", "GET", http.StatusNoContent, "*", "GET", ""},
+		{"admin PUT", "/item/1", "https://admin.example.com", "PUT", http.StatusNoContent, "https://admin.example.com", "PUT", "true"},
+		{"PUT from elsewhere", "/item/1", "https://any.example.com", "PUT", http.StatusNoContent, "", "", ""},
+		{"DELETE is not there", "/item/1", "https://any.example.com", "DELETE", http.StatusNoContent, "", "", ""},
+		{"no method in annotation", "/ping", "https://any.example.com", "POST", http.StatusNoContent, "*", "GET, POST", ""},
+		{"plain OPTIONS", "/item/1", "", "", http.StatusMethodNotAllowed, "", "", ""},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodOptions, tc.path, nil)
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		if tc.method != "" {
+			req.Header.Set("Access-Control-Request-Method", tc.method)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+
+		if w.Code != tc.status {
+			t.Errorf("[%s] expected status %d, got %d", tc.name, tc.status, w.Code)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tc.allowOrigin {
+			t.Errorf("[%s] expected allow origin %q, got %q", tc.name, tc.allowOrigin, got)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Methods"); got != tc.methods {
+			t.Errorf("[%s] expected allow methods %q, got %q", tc.name, tc.methods, got)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Credentials"); got != tc.credentials {
+			t.Errorf("[%s] expected credentials %q, got %q", tc.name, tc.credentials, got)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodOptions, "/item/1", nil)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	if w.Header().Get("Allow") != "GET, PUT" {
+		t.Errorf("expected Allow: GET, PUT, got %q", w.Header().Get("Allow"))
+	}
+}
+
+func TestActualRequest(t *testing.T) {
+	api := &ItemApi{}
+	req := httptest.NewRequest(http.MethodPut, "/item/7", nil)
+	req.Header.Set("Origin", "https://admin.example.com")
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://admin.example.com" || w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("unexpected response %d %v", w.Code, w.Header())
+	}
+}
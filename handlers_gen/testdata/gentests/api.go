@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+type ApiError struct {
+	HTTPStatus int
+	Err        error
+	Code       string
+}
+
+func (ae ApiError) Error() string {
+	return ae.Err.Error()
+}
+
+func (ae ApiError) ErrorCode() string {
+	return ae.Code
+}
+
+type ShopApi struct {
+	auth    AuthSecrets
+	limiter RateLimiter
+	routes  ApiRoutes
+	orders  int
+}
+
+func NewShopApi(secrets AuthSecrets) *ShopApi {
+	return &ShopApi{auth: secrets, limiter: NewMemoryRateLimiter()}
+}
+
+type OrderParams struct {
+	Item  string `apivalidator:"required,min=2,max=8"`
+	Count int    `apivalidator:"min=1,max=10,default=1"`
+	Color string `apivalidator:"enum=red|green,default=red"`
+	Size  int    `apivalidator:"enum=36|38|40"`
+	Note  string
+}
+
+type SearchParams struct {
+	Query string `apivalidator:"paramname=q,max=20"`
+	Page  int    `apivalidator:"min=1,default=1"`
+}
+
+type Order struct {
+	ID    int    `json:"id"`
+	Item  string `json:"item"`
+	Count int    `json:"count"`
+	Color string `json:"color"`
+}
+
+// у каждого клиента один заказ в минуту: тесты не должны упираться в лимит
+// apigen:api {"url": "/order", "method": "POST", "auth": true, "rate_limit": "1/m", "burst": 1}
+func (srv *ShopApi) Order(ctx context.Context, in OrderParams) (*Order, error) {
+	if in.Count == 0 || in.Color == "" {
+		return nil, ApiError{HTTPStatus: http.StatusBadRequest, Err: errors.New("defaults were not applied")}
+	}
+	srv.orders++
+	return &Order{ID: srv.orders, Item: in.Item, Count: in.Count, Color: in.Color}, nil
+}
+
+// apigen:api {"url": "/search", "method": "GET"}
+func (srv *ShopApi) Search(ctx context.Context, in SearchParams) ([]*Order, error) {
+	if in.Page != 1 {
+		return nil, ApiError{HTTPStatus: http.StatusBadRequest, Err: errors.New("default page was not applied")}
+	}
+	return nil, nil
+}
+
+// конструктора нет - тесты берут &AdminApi{}
+// apigen:api {"format": "problem"}
+type AdminApi struct {
+	auth   AuthSecrets
+	routes ApiRoutes
+}
+
+type BanParams struct {
+	Login string `apivalidator:"required"`
+	Days  int    `apivalidator:"required,max=365"`
+}
+
+type Empty struct{}
+
+// apigen:api {"url": "/admin/ban", "method": "POST", "auth": true}
+func (srv *AdminApi) Ban(ctx context.Context, in BanParams) (*Empty, error) {
+	return &Empty{}, nil
+}
+
+type WhoamiParams struct{}
+
+type Caller struct {
+	Principal string `json:"principal"`
+}
+
+// apigen:api {"url": "/admin/whoami", "auth": "mtls"}
+func (srv *AdminApi) Whoami(ctx context.Context, in WhoamiParams) (*Caller, error) {
+	principal, _ := PrincipalFromContext(ctx)
+	return &Caller{Principal: principal}, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+type ApiError struct {
+	HTTPStatus int
+	Err        error
+}
+
+func (ae ApiError) Error() string {
+	return ae.Err.Error()
+}
+
+// apigen:api {"health": "/"}
+type PingApi struct {
+	down   bool
+	routes ApiRoutes
+}
+
+func (srv *PingApi) Ready(ctx context.Context) error {
+	if srv.down {
+		return errors.New("warming up")
+	}
+	return nil
+}
+
+type PingParams struct {
+	Name string
+}
+
+type Pong struct {
+	Name string `json:"name"`
+}
+
+// apigen:api {"url": "/ping", "method": "GET"}
+func (srv *PingApi) Ping(ctx context.Context, in PingParams) (*Pong, error) {
+	return &Pong{Name: in.Name}, nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHealthRoutes(t *testing.T) {
+	cases := []struct {
+		name   string
+		api    *PingApi
+		method string
+		path   string
+		status int
+		body   string
+	}{
+		{"healthz", &PingApi{down: true}, http.MethodGet, "/healthz", http.StatusOK, `"status":"ok"`},
+		{"ready", &PingApi{}, http.MethodGet, "/readyz", http.StatusOK, `"status":"ready"`},
+		{"not ready", &PingApi{down: true}, http.MethodGet, "/readyz", http.StatusServiceUnavailable, `"error":"warming up"`},
+		{"version", &PingApi{}, http.MethodGet, "/version", http.StatusOK, `"generator":"` + apiGeneratorVersion + `"`},
+		{"HEAD", &PingApi{}, http.MethodHead, "/healthz", http.StatusOK, ""},
+		{"only GET", &PingApi{}, http.MethodPost, "/healthz", http.StatusMethodNotAllowed, `"error":"bad method"`},
+		{"only GET readyz", &PingApi{}, http.MethodDelete, "/readyz", http.StatusMethodNotAllowed, `"error":"bad method"`},
+		{"api still works", &PingApi{}, http.MethodGet, "/ping?name=x", http.StatusOK, `"name":"x"`},
+	}
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		tc.api.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Code != tc.status {
+			t.Errorf("[%s] expected status %d, got %d", tc.name, tc.status, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), tc.body) {
+			t.Errorf("[%s] expected %s in %s", tc.name, tc.body, w.Body.String())
+		}
+		if tc.status == http.StatusMethodNotAllowed && w.Header().Get("Allow") != "GET, HEAD" {
+			t.Errorf("[%s] expected Allow: GET, HEAD, got %q", tc.name, w.Header().Get("Allow"))
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+type ApiError struct {
+	HTTPStatus int
+	Err        error
+	Code       string
+}
+
+func (ae ApiError) Error() string {
+	return ae.Err.Error()
+}
+
+func (ae ApiError) ErrorCode() string {
+	return ae.Code
+}
+
+type PayApi struct {
+	store IdempotencyStore
+	calls atomic.Int32
+	// block - если не nil, Charge ждёт его закрытия
+	block chan struct{}
+}
+
+type ChargeParams struct {
+	Amount int    `apivalidator:"min=1"`
+	Mode   string `apivalidator:"enum=ok|fail|panic,default=ok"`
+}
+
+type Charge struct {
+	Call int `json:"call"`
+}
+
+// apigen:api {"url": "/charge", "method": "POST", "idempotent": true}
+func (srv *PayApi) Charge(ctx context.Context, in ChargeParams) (*Charge, error) {
+	call := srv.calls.Add(1)
+	if srv.block != nil {
+		<-srv.block
+	}
+	switch in.Mode {
+	case "fail":
+		return nil, ApiError{HTTPStatus: http.StatusServiceUnavailable, Err: errors.New("bank is down")}
+	case "panic":
+		panic("bank exploded")
+	}
+	return &Charge{Call: int(call)}, nil
+}
+
+// apigen:api {"url": "/refund", "method": "POST", "idempotent": true}
+func (srv *PayApi) Refund(ctx context.Context, in ChargeParams) (*Charge, error) {
+	return &Charge{Call: int(srv.calls.Add(1))}, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func charge(t *testing.T, url, key, query string) (int, string) {
+	t.Helper()
+	resp, body := post(t, url+"/charge", key, query)
+	return resp.StatusCode, body
+}
+
+func post(t *testing.T, url, key, query string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(query))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Idempotency-Key", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, strings.TrimSpace(string(body))
+}
+
+func TestReplay(t *testing.T) {
+	ts := httptest.NewServer(&PayApi{store: NewMemoryIdempotencyStore(time.Hour)})
+	defer ts.Close()
+
+	for i := 0; i < 3; i++ {
+		status, body := charge(t, ts.URL, "k", "amount=10")
+		if status != http.StatusOK || body != `{"error":"","response":{"call":1}}` {
+			t.Errorf("attempt %d: unexpected %d %s", i, status, body)
+		}
+	}
+	// ошибки валидации тоже повторяются как есть
+	for i := 0; i < 2; i++ {
+		status, body := charge(t, ts.URL, "bad", "amount=0")
+		if status != http.StatusBadRequest || !strings.Contains(body, "param_below_min") {
+			t.Errorf("attempt %d: unexpected %d %s", i, status, body)
+		}
+	}
+}
+
+// ключ занимается отдельно для каждого метода: тот же ключ у /refund - не повтор /charge
+func TestKeyPerMethod(t *testing.T) {
+	ts := httptest.NewServer(&PayApi{store: NewMemoryIdempotencyStore(time.Hour)})
+	defer ts.Close()
+
+	first, _ := post(t, ts.URL+"/charge", "k", "amount=10")
+	resp, body := post(t, ts.URL+"/refund", "k", "amount=10")
+	if resp.StatusCode != http.StatusOK || body != `{"error":"","response":{"call":2}}` {
+		t.Errorf("expected refund to run, got %d %s", resp.StatusCode, body)
+	}
+
+	replay, _ := post(t, ts.URL+"/charge", "k", "amount=10")
+	if replay.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatal("expected replay")
+	}
+	if id := replay.Header.Get("X-Request-Id"); id == "" || id == first.Header.Get("X-Request-Id") {
+		t.Errorf("expected own X-Request-Id on replay, got %q", id)
+	}
+}
+
+func TestNoStore(t *testing.T) {
+	api := &PayApi{}
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	charge(t, ts.URL, "k", "amount=10")
+	if _, body := charge(t, ts.URL, "k", "amount=10"); body != `{"error":"","response":{"call":2}}` {
+		t.Errorf("without store every request must run, got %s", body)
+	}
+}
+
+func TestInProgress(t *testing.T) {
+	api := &PayApi{store: NewMemoryIdempotencyStore(time.Hour), block: make(chan struct{})}
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	done := make(chan string)
+	go func() {
+		_, body := charge(t, ts.URL, "slow", "amount=10")
+		done <- body
+	}()
+	for api.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	status, body := charge(t, ts.URL, "slow", "amount=10")
+	if status != http.StatusConflict || !strings.Contains(body, "idempotency_key_in_use") {
+		t.Errorf("expected 409 while first request runs, got %d %s", status, body)
+	}
+	close(api.block)
+	if body := <-done; body != `{"error":"","response":{"call":1}}` {
+		t.Errorf("unexpected first response %s", body)
+	}
+}
+
+// 5xx и паники не запоминаются - повтор выполняется заново
+func TestFailuresReleaseKey(t *testing.T) {
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(out)
+
+	ts := httptest.NewServer(&PayApi{store: NewMemoryIdempotencyStore(time.Hour)})
+	defer ts.Close()
+
+	for _, mode := range []string{"fail", "panic"} {
+		key := "release-" + mode
+		status, _ := charge(t, ts.URL, key, "amount=10&mode="+mode)
+		if status < 500 {
+			t.Errorf("[%s] expected 5xx, got %d", mode, status)
+		}
+		status, body := charge(t, ts.URL, key, "amount=10&mode="+mode)
+		if status < 500 || strings.Contains(body, "idempotency") {
+			t.Errorf("[%s] expected retry to run again, got %d %s", mode, status, body)
+		}
+	}
+}
+
+func TestExpire(t *testing.T) {
+	store := NewMemoryIdempotencyStore(time.Minute)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	ts := httptest.NewServer(&PayApi{store: store})
+	defer ts.Close()
+
+	charge(t, ts.URL, "k", "amount=10")
+	now = now.Add(2 * time.Minute)
+	if _, body := charge(t, ts.URL, "k", "amount=10"); body != `{"error":"","response":{"call":2}}` {
+		t.Errorf("expected expired key to run again, got %s", body)
+	}
+	if len(store.entries) != 1 {
+		t.Errorf("expected expired entry to be swept, got %d entries", len(store.entries))
+	}
+}
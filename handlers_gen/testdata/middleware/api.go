@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+type ApiError struct {
+	HTTPStatus int
+	Err        error
+}
+
+func (ae ApiError) Error() string {
+	return ae.Err.Error()
+}
+
+// apigen:api {"middleware": ["outer", "inner"]}
+type TraceApi struct {
+	MiddlewareRegistry
+	routes ApiRoutes
+}
+
+// trace дописывает name в заголовок X-Trace до и после вызова next
+func trace(name string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Trace", name)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func NewTraceApi() *TraceApi {
+	api := &TraceApi{}
+	api.Use("outer", trace("outer"))
+	api.Use("inner", trace("inner"))
+	api.Use("endpoint", trace("endpoint"))
+	return api
+}
+
+type PingParams struct {
+	Name string
+}
+
+type Pong struct {
+	Name string `json:"name"`
+}
+
+// apigen:api {"url": "/ping", "middleware": ["endpoint"]}
+func (srv *TraceApi) Ping(ctx context.Context, in PingParams) (*Pong, error) {
+	return &Pong{in.Name}, nil
+}
+
+// apigen:api {"url": "/plain"}
+func (srv *TraceApi) Plain(ctx context.Context, in PingParams) (*Pong, error) {
+	return &Pong{in.Name}, nil
+}
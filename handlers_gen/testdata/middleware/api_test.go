@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestMiddlewareOrder(t *testing.T) {
+	ts := httptest.NewServer(NewTraceApi())
+	defer ts.Close()
+
+	cases := []struct {
+		Path   string
+		Status int
+		Trace  []string
+	}{
+		{"/ping?name=a", http.StatusOK, []string{"outer", "inner", "endpoint"}},
+		{"/plain?name=a", http.StatusOK, []string{"outer", "inner"}},
+		{"/unknown", http.StatusNotFound, []string{"outer", "inner"}},
+	}
+
+	for idx, item := range cases {
+		resp, err := http.Get(ts.URL + item.Path)
+		if err != nil {
+			t.Fatalf("[%d] request error: %v", idx, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != item.Status {
+			t.Errorf("[%d] expected http status %v, got %v", idx, item.Status, resp.StatusCode)
+		}
+		if got := resp.Header.Values("X-Trace"); !reflect.DeepEqual(got, item.Trace) {
+			t.Errorf("[%d] expected middleware order %v, got %v", idx, item.Trace, got)
+		}
+	}
+}
+
+func TestMiddlewareNotRegistered(t *testing.T) {
+	api := &TraceApi{}
+	if _, err := api.Wrap(http.NotFoundHandler(), "missing"); err == nil {
+		t.Error("expected error from Wrap for unregistered middleware")
+	}
+	if _, err := api.Handler(); err == nil {
+		t.Error("expected error from Handler for unregistered middleware")
+	}
+
+	// ошибка сборки не роняет запрос паникой
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ping", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected http status %v, got %v", http.StatusInternalServerError, rec.Code)
+	}
+}
+
+func TestMiddlewarePerInstance(t *testing.T) {
+	first, second := NewTraceApi(), &TraceApi{}
+	second.Use("outer", trace("second"))
+	second.Use("inner", trace("second"))
+	second.Use("endpoint", trace("second"))
+
+	for _, api := range []*TraceApi{first, second} {
+		if _, err := api.Handler(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	second.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/plain?name=a", nil))
+	if got, want := rec.Header().Values("X-Trace"), []string{"second", "second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected middleware %v, got %v", want, got)
+	}
+}
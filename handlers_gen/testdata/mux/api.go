@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+type ApiError struct {
+	HTTPStatus int
+	Err        error
+}
+
+func (ae ApiError) Error() string {
+	return ae.Err.Error()
+}
+
+type UserApi struct {
+	names  map[string]string
+	auth   AuthSecrets
+	routes ApiRoutes
+}
+
+type ProfileParams struct {
+	Login string `apivalidator:"required,min=3"`
+}
+
+type RenameParams struct {
+	Login string `apivalidator:"required"`
+	Name  string `apivalidator:"paramname=full_name,required"`
+}
+
+type User struct {
+	Login    string `json:"login"`
+	FullName string `json:"full_name"`
+}
+
+// apigen:api {"url": "/user/{login}", "method": "GET"}
+func (srv *UserApi) Profile(ctx context.Context, in ProfileParams) (*User, error) {
+	name, ok := srv.names[in.Login]
+	if !ok {
+		return nil, ApiError{http.StatusNotFound, fmt.Errorf("user not exist")}
+	}
+	return &User{Login: in.Login, FullName: name}, nil
+}
+
+// apigen:api {"url": "/user/{login}", "method": "PUT", "auth": true}
+func (srv *UserApi) Rename(ctx context.Context, in RenameParams) (*User, error) {
+	srv.names[in.Login] = in.Name
+	return &User{Login: in.Login, FullName: in.Name}, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMux(t *testing.T) {
+	ts := httptest.NewServer(&UserApi{names: map[string]string{"rvasily": "Vasily Romanov"}, auth: AuthSecrets{"test": "100500"}})
+	defer ts.Close()
+
+	cases := []struct {
+		Method string
+		Path   string
+		Body   string
+		Auth   bool
+		Status int
+		Result string
+		Allow  string
+	}{
+		{"GET", "/user/rvasily", "", false, 200, `{"error":"","response":{"login":"rvasily","full_name":"Vasily Romanov"}}`, ""},
+		{"GET", "/user/nobody", "", false, 404, `{"error":"user not exist"}`, ""},
+		{"GET", "/user/ab", "", false, 400, `{"error":"login len must be >= 3"}`, ""},
+		{"PUT", "/user/rvasily", "full_name=Ivan", false, 403, `{"error":"unauthorized"}`, ""},
+		{"PUT", "/user/rvasily", "full_name=Ivan", true, 200, `{"error":"","response":{"login":"rvasily","full_name":"Ivan"}}`, ""},
+		{"DELETE", "/user/rvasily", "", false, 405, `{"error":"bad method"}`, "GET, PUT"},
+		{"GET", "/unknown", "", false, 404, `{"error":"unknown method"}`, ""},
+	}
+
+	for idx, item := range cases {
+		req, _ := http.NewRequest(item.Method, ts.URL+item.Path, strings.NewReader(item.Body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if item.Auth {
+			req.Header.Set("X-Auth", "100500")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("[%d] request error: %v", idx, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != item.Status {
+			t.Errorf("[%d] expected http status %v, got %v", idx, item.Status, resp.StatusCode)
+		}
+		var got, expected interface{}
+		json.Unmarshal(body, &got)
+		json.Unmarshal([]byte(item.Result), &expected)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("[%d] results not match\nGot: %s\nExpected: %s", idx, body, item.Result)
+		}
+		if got := resp.Header.Get("Allow"); got != item.Allow {
+			t.Errorf("[%d] expected Allow %q, got %q", idx, item.Allow, got)
+		}
+	}
+}
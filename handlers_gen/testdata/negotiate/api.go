@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+)
+
+type ApiError struct {
+	HTTPStatus int
+	Err        error
+}
+
+func (ae ApiError) Error() string {
+	return ae.Err.Error()
+}
+
+// apigen:api {"encoders": ["msgpack", "binpack"]}
+type PackApi struct{}
+
+type HeroParams struct {
+	Login string `apivalidator:"required"`
+	Level int
+}
+
+type Hero struct {
+	Login  string `json:"login"`
+	Secret string `json:"-" cgen:"-"`
+	Level  int    `json:"level"`
+}
+
+// apigen:api {"url": "/hero"}
+func (srv *PackApi) Hero(ctx context.Context, in HeroParams) (*Hero, error) {
+	return &Hero{Login: in.Login, Secret: "x", Level: in.Level}, nil
+}
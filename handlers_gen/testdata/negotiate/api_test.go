@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	ts := httptest.NewServer(&PackApi{})
+	defer ts.Close()
+
+	msgpackHero := []byte("\x82\xa5error\xa0\xa8response\x82\xa5login\xa2ab\xa5level\x01")
+	binpackHero := []byte("\x00\x00\x00\x00\x02\x00\x00\x00ab\x01\x00\x00\x00")
+	jsonHero := []byte(`{"error":"","response":{"login":"ab","level":1}}` + "\n")
+
+	cases := []struct {
+		Query  string
+		Accept string
+		Status int
+		Type   string
+		Body   []byte
+	}{
+		{"login=ab&level=1", "", 200, "application/json", jsonHero},
+		{"login=ab&level=1", "text/html", 200, "application/json", jsonHero},
+		{"login=ab&level=1", "*/*", 200, "application/json", jsonHero},
+		{"login=ab&level=1", "application/msgpack", 200, "application/msgpack", msgpackHero},
+		{"login=ab&level=1", "application/*;q=0.1, application/x-msgpack;q=0.9", 200, "application/msgpack", msgpackHero},
+		{"login=ab&level=1", "application/json;q=0.5, application/x-binpack", 200, "application/x-binpack", binpackHero},
+		{"level=1", "application/msgpack", 400, "application/msgpack", []byte("\x81\xa5error\xb7login must me not empty")},
+		{"level=1", "application/x-binpack", 400, "application/x-binpack", []byte("\x17\x00\x00\x00login must me not empty")},
+	}
+
+	for idx, item := range cases {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/hero?"+item.Query, nil)
+		if item.Accept != "" {
+			req.Header.Set("Accept", item.Accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("[%d] request error: %v", idx, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != item.Status {
+			t.Errorf("[%d] expected http status %v, got %v", idx, item.Status, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Content-Type"); got != item.Type {
+			t.Errorf("[%d] expected Content-Type %q, got %q", idx, item.Type, got)
+		}
+		if got := resp.Header.Get("Vary"); got != "Accept" {
+			t.Errorf("[%d] expected Vary: Accept, got %q", idx, got)
+		}
+		if !bytes.Equal(body, item.Body) {
+			t.Errorf("[%d] body not match\nGot: %q\nExpected: %q", idx, body, item.Body)
+		}
+	}
+}
+
+func TestMsgpackValues(t *testing.T) {
+	cases := []struct {
+		Value interface{}
+		Pack  []byte
+	}{
+		{nil, []byte{0xc0}},
+		{true, []byte{0xc3}},
+		{-1, []byte{0xff}},
+		{-33, []byte{0xd0, 0xdf}},
+		{-200, []byte{0xd1, 0xff, 0x38}},
+		{200, []byte{0xcc, 0xc8}},
+		{uint64(1) << 40, []byte{0xcf, 0, 0, 1, 0, 0, 0, 0, 0}},
+		{1.5, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{[]int{1, 2}, []byte{0x92, 1, 2}},
+		{[]byte{1, 2}, []byte{0xc4, 2, 1, 2}},
+		{string(bytes.Repeat([]byte("a"), 40)), append([]byte{0xd9, 40}, bytes.Repeat([]byte("a"), 40)...)},
+	}
+	for idx, item := range cases {
+		got := appendApiMsgpack(nil, reflect.ValueOf(&item.Value).Elem())
+		if !bytes.Equal(got, item.Pack) {
+			t.Errorf("[%d] %#v packed as % x, expected % x", idx, item.Value, got, item.Pack)
+		}
+	}
+}
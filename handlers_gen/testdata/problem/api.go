@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+type ApiError struct {
+	HTTPStatus int
+	Err        error
+	Code       string
+	Details    map[string]interface{}
+}
+
+func (ae ApiError) Error() string {
+	return ae.Err.Error()
+}
+
+func (ae ApiError) ErrorCode() string {
+	return ae.Code
+}
+
+func (ae ApiError) ErrorDetails() map[string]interface{} {
+	return ae.Details
+}
+
+// apigen:api {"format": "problem", "problem_type": "https://example.com/problems/"}
+type ProblemApi struct {
+	auth   AuthSecrets
+	routes ApiRoutes
+}
+
+type LookupParams struct {
+	Login string `apivalidator:"required,min=3"`
+}
+
+type User struct {
+	Login string `json:"login"`
+}
+
+// apigen:api {"url": "/user/lookup", "method": "POST", "auth": true}
+func (srv *ProblemApi) Lookup(ctx context.Context, in LookupParams) (*User, error) {
+	switch in.Login {
+	case "rvasily":
+		return &User{in.Login}, nil
+	case "broken":
+		return nil, errors.New("storage is down")
+	}
+	return nil, ApiError{HTTPStatus: http.StatusNotFound, Err: errors.New("user not exist"), Code: "user_not_found"}
+}
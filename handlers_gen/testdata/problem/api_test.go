@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type CR map[string]interface{}
+
+func TestProblemFormat(t *testing.T) {
+	ts := httptest.NewServer(&ProblemApi{auth: AuthSecrets{"test": "100500"}})
+	defer ts.Close()
+
+	cases := []struct {
+		Path   string
+		Body   string
+		Auth   bool
+		Status int
+		Type   string
+		Result CR
+	}{
+		{"/user/lookup", "login=rvasily", true, http.StatusOK, "application/json", CR{
+			"error":    "",
+			"response": CR{"login": "rvasily"},
+		}},
+		{"/user/lookup", "login=ab", true, http.StatusBadRequest, "application/problem+json", CR{
+			"type":           "https://example.com/problems/param_below_min",
+			"title":          "Bad Request",
+			"status":         400,
+			"detail":         "login len must be >= 3",
+			"instance":       "/user/lookup",
+			"code":           "param_below_min",
+			"details":        CR{"param": "login", "min": 3},
+			"invalid-params": []CR{{"name": "login", "reason": "login len must be >= 3"}},
+		}},
+		{"/user/lookup", "login=nobody", false, http.StatusForbidden, "application/problem+json", CR{
+			"type":     "https://example.com/problems/unauthorized",
+			"title":    "Forbidden",
+			"status":   403,
+			"detail":   "unauthorized",
+			"instance": "/user/lookup",
+			"code":     "unauthorized",
+		}},
+		{"/user/lookup", "login=nobody", true, http.StatusNotFound, "application/problem+json", CR{
+			"type":     "https://example.com/problems/user_not_found",
+			"title":    "Not Found",
+			"status":   404,
+			"detail":   "user not exist",
+			"instance": "/user/lookup",
+			"code":     "user_not_found",
+		}},
+		{"/user/lookup", "login=broken", true, http.StatusInternalServerError, "application/problem+json", CR{
+			"type":     "about:blank",
+			"title":    "Internal Server Error",
+			"status":   500,
+			"detail":   "storage is down",
+			"instance": "/user/lookup",
+		}},
+		{"/unknown", "", false, http.StatusNotFound, "application/problem+json", CR{
+			"type":     "https://example.com/problems/unknown_method",
+			"title":    "Not Found",
+			"status":   404,
+			"detail":   "unknown method",
+			"instance": "/unknown",
+			"code":     "unknown_method",
+		}},
+	}
+
+	for idx, item := range cases {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+item.Path, strings.NewReader(item.Body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if item.Auth {
+			req.Header.Set("X-Auth", "100500")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("[%d] request error: %v", idx, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != item.Status {
+			t.Errorf("[%d] expected http status %v, got %v", idx, item.Status, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Content-Type"); got != item.Type {
+			t.Errorf("[%d] expected Content-Type %q, got %q", idx, item.Type, got)
+		}
+
+		var got, expected interface{}
+		json.Unmarshal(body, &got)
+		data, _ := json.Marshal(item.Result)
+		json.Unmarshal(data, &expected)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("[%d] results not match\nGot: %s\nExpected: %s", idx, body, data)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+)
+
+type ApiError struct {
+	HTTPStatus int
+	Err        error
+	Code       string
+	Details    map[string]interface{}
+}
+
+func (ae ApiError) Error() string {
+	return ae.Err.Error()
+}
+
+func (ae ApiError) ErrorCode() string {
+	return ae.Code
+}
+
+func (ae ApiError) ErrorDetails() map[string]interface{} {
+	return ae.Details
+}
+
+type SearchApi struct {
+	limiter RateLimiter
+	auth    AuthSecrets
+	routes  ApiRoutes
+}
+
+type SearchParams struct {
+	Query string
+}
+
+type Found struct {
+	Query string `json:"query"`
+}
+
+// apigen:api {"url": "/search", "rate_limit": "2/s", "burst": 3}
+func (srv *SearchApi) Search(ctx context.Context, in SearchParams) (*Found, error) {
+	return &Found{Query: in.Query}, nil
+}
+
+// apigen:api {"url": "/slow", "rate_limit": "6/m"}
+func (srv *SearchApi) Slow(ctx context.Context, in SearchParams) (*Found, error) {
+	return &Found{Query: in.Query}, nil
+}
+
+// apigen:api {"url": "/private", "auth": true, "rate_limit": "1/m"}
+func (srv *SearchApi) Private(ctx context.Context, in SearchParams) (*Found, error) {
+	return &Found{Query: in.Query}, nil
+}
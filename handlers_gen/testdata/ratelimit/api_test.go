@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func call(api http.Handler, path, ip, principal string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = ip + ":12345"
+	if principal != "" {
+		req = req.WithContext(WithPrincipal(req.Context(), principal))
+	}
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, req)
+	return w
+}
+
+func TestTokenBucket(t *testing.T) {
+	limiter := NewMemoryRateLimiter()
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+	api := &SearchApi{limiter: limiter}
+
+	for i := 0; i < 3; i++ {
+		if w := call(api, "/search", "10.0.0.1", ""); w.Code != http.StatusOK {
+			t.Fatalf("burst request %d: expected 200, got %d", i, w.Code)
+		}
+	}
+
+	w := call(api, "/search", "10.0.0.1", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 after burst, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("expected Retry-After 1, got %q", got)
+	}
+	body := strings.TrimSpace(w.Body.String())
+	if body != `{"code":"rate_limited","details":{"retry_after":1},"error":"too many requests"}` {
+		t.Errorf("unexpected body %s", body)
+	}
+
+	// у другого клиента и другого метода - свои корзины
+	if w := call(api, "/search", "10.0.0.2", ""); w.Code != http.StatusOK {
+		t.Errorf("other ip must not be limited, got %d", w.Code)
+	}
+	if w := call(api, "/slow", "10.0.0.1", ""); w.Code != http.StatusOK {
+		t.Errorf("other method must not be limited, got %d", w.Code)
+	}
+
+	// 2/s - через полсекунды есть один токен
+	now = now.Add(500 * time.Millisecond)
+	if w := call(api, "/search", "10.0.0.1", ""); w.Code != http.StatusOK {
+		t.Errorf("expected refill after 500ms, got %d", w.Code)
+	}
+	if w := call(api, "/search", "10.0.0.1", ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429 again, got %d", w.Code)
+	}
+}
+
+func TestRetryAfterMinutes(t *testing.T) {
+	limiter := NewMemoryRateLimiter()
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+	api := &SearchApi{limiter: limiter}
+
+	for i := 0; i < 6; i++ {
+		call(api, "/slow", "10.0.0.1", "")
+	}
+	w := call(api, "/slow", "10.0.0.1", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "10" {
+		t.Errorf("expected 429 with Retry-After 10, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+// за одним NAT разные пользователи не мешают друг другу
+func TestPrincipalKey(t *testing.T) {
+	api := &SearchApi{limiter: NewMemoryRateLimiter()}
+	for i := 0; i < 3; i++ {
+		call(api, "/search", "10.0.0.1", "alice")
+	}
+	if w := call(api, "/search", "10.0.0.1", "alice"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected alice to be limited, got %d", w.Code)
+	}
+	if w := call(api, "/search", "10.0.0.1", "bob"); w.Code != http.StatusOK {
+		t.Errorf("expected bob to pass, got %d", w.Code)
+	}
+}
+
+// nil в поле - лимиты не считаются
+func TestNilLimiter(t *testing.T) {
+	api := &SearchApi{}
+	for i := 0; i < 5; i++ {
+		if w := call(api, "/search", "10.0.0.3", ""); w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200 without limiter, got %d", i, w.Code)
+		}
+	}
+}
+
+// у каждого экземпляра свои корзины
+func TestLimiterPerInstance(t *testing.T) {
+	first, second := &SearchApi{limiter: NewMemoryRateLimiter()}, &SearchApi{limiter: NewMemoryRateLimiter()}
+	for i := 0; i < 3; i++ {
+		call(first, "/search", "10.0.0.4", "")
+	}
+	if w := call(first, "/search", "10.0.0.4", ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected first to be limited, got %d", w.Code)
+	}
+	if w := call(second, "/search", "10.0.0.4", ""); w.Code != http.StatusOK {
+		t.Errorf("expected second to pass, got %d", w.Code)
+	}
+}
+
+// лимит считается после auth по principal: у клиентов за одним IP свои корзины,
+// а запросы с чужим секретом отбиваются раньше и корзину не тратят
+func TestLimitAfterAuth(t *testing.T) {
+	api := &SearchApi{limiter: NewMemoryRateLimiter(), auth: AuthSecrets{"alice": "a", "bob": "b"}}
+	private := func(secret string) int {
+		req := httptest.NewRequest(http.MethodGet, "/private", nil)
+		req.RemoteAddr = "10.0.0.5:12345"
+		req.Header.Set("X-Auth", secret)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := private("wrong"); code != http.StatusForbidden {
+		t.Errorf("expected 403 for wrong secret, got %d", code)
+	}
+	for _, tc := range []struct {
+		secret string
+		status int
+	}{
+		{"a", http.StatusOK},
+		{"b", http.StatusOK},
+		{"a", http.StatusTooManyRequests},
+		{"wrong", http.StatusForbidden},
+	} {
+		if code := private(tc.secret); code != tc.status {
+			t.Errorf("X-Auth %q: expected %d, got %d", tc.secret, tc.status, code)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"log"
+)
+
+type ApiError struct {
+	HTTPStatus int
+	Err        error
+}
+
+func (ae ApiError) Error() string {
+	return ae.Err.Error()
+}
+
+type PanicApi struct {
+	logger *log.Logger
+}
+
+type BoomParams struct {
+	Reason string `apivalidator:"required"`
+}
+
+type Result struct {
+	OK bool `json:"ok"`
+}
+
+// apigen:api {"url": "/boom"}
+func (srv *PanicApi) Boom(ctx context.Context, in BoomParams) (*Result, error) {
+	if in.Reason == "nil" {
+		var res *Result
+		res.OK = true
+	}
+	panic(in.Reason)
+}
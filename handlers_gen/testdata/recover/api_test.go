@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPanicRecovered(t *testing.T) {
+	var logs bytes.Buffer
+	ts := httptest.NewServer(&PanicApi{logger: log.New(&logs, "", 0)})
+	defer ts.Close()
+
+	for _, reason := range []string{"kaboom", "nil"} {
+		logs.Reset()
+		resp, err := http.Get(ts.URL + "/boom?reason=" + reason)
+		if err != nil {
+			t.Fatalf("[%s] request error: %v", reason, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Errorf("[%s] expected http status 500, got %v", reason, resp.StatusCode)
+		}
+		if got := strings.TrimSpace(string(body)); got != `{"error":"internal server error"}` {
+			t.Errorf("[%s] unexpected body %s", reason, got)
+		}
+		if !strings.Contains(logs.String(), "panic serving GET /boom") || !strings.Contains(logs.String(), "goroutine") {
+			t.Errorf("[%s] expected panic with stack in log, got %q", reason, logs.String())
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+type ApiError struct {
+	HTTPStatus int
+	Err        error
+}
+
+func (ae ApiError) Error() string {
+	return ae.Err.Error()
+}
+
+// на /item висят GET и PUT, на /any - POST и метод без "method"
+type ShopApi struct {
+	routes ApiRoutes
+}
+
+type ItemParams struct {
+	Name string `apivalidator:"default=apple"`
+}
+
+// Item - кто из методов структуры ответил
+type Item struct {
+	Method string `json:"method"`
+	Name   string `json:"name"`
+}
+
+// apigen:api {"url": "/item", "method": "GET"}
+func (srv *ShopApi) Get(ctx context.Context, in ItemParams) (*Item, error) {
+	return &Item{Method: "Get", Name: in.Name}, nil
+}
+
+// apigen:api {"url": "/item", "method": "PUT", "cors": {"origins": ["https://admin.example.com"]}}
+func (srv *ShopApi) Put(ctx context.Context, in ItemParams) (*Item, error) {
+	return &Item{Method: "Put", Name: in.Name}, nil
+}
+
+// apigen:api {"url": "/any", "method": "POST"}
+func (srv *ShopApi) Post(ctx context.Context, in ItemParams) (*Item, error) {
+	return &Item{Method: "Post", Name: in.Name}, nil
+}
+
+// apigen:api {"url": "/any"}
+func (srv *ShopApi) Any(ctx context.Context, in ItemParams) (*Item, error) {
+	return &Item{Method: "Any", Name: in.Name}, nil
+}
+
+// то же с middleware: в режиме switch обёртки собираются в buildHandler
+// apigen:api {"middleware": ["trace"]}
+type TracedApi struct {
+	MiddlewareRegistry
+	routes ApiRoutes
+}
+
+func NewTracedApi() *TracedApi {
+	api := &TracedApi{}
+	api.Use("trace", func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Trace", "on")
+			next.ServeHTTP(w, r)
+		})
+	})
+	return api
+}
+
+// apigen:api {"url": "/item", "method": "GET"}
+func (srv *TracedApi) Get(ctx context.Context, in ItemParams) (*Item, error) {
+	return &Item{Method: "Get", Name: in.Name}, nil
+}
+
+// apigen:api {"url": "/item", "method": "PUT"}
+func (srv *TracedApi) Put(ctx context.Context, in ItemParams) (*Item, error) {
+	return &Item{Method: "Put", Name: in.Name}, nil
+}
+
+// apigen:api {"url": "/any", "method": "POST"}
+func (srv *TracedApi) Post(ctx context.Context, in ItemParams) (*Item, error) {
+	return &Item{Method: "Post", Name: in.Name}, nil
+}
+
+// apigen:api {"url": "/any"}
+func (srv *TracedApi) Any(ctx context.Context, in ItemParams) (*Item, error) {
+	return &Item{Method: "Any", Name: in.Name}, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestSharedURL(t *testing.T) {
+	apis := []struct {
+		name  string
+		api   http.Handler
+		trace string
+	}{
+		{"plain", &ShopApi{}, ""},
+		{"middleware", NewTracedApi(), "on"},
+	}
+	cases := []struct {
+		Method string
+		Path   string
+		Status int
+		Result string
+		Allow  string
+	}{
+		{"GET", "/item", 200, `{"error":"","response":{"method":"Get","name":"apple"}}`, ""},
+		{"PUT", "/item?name=pear", 200, `{"error":"","response":{"method":"Put","name":"pear"}}`, ""},
+		{"DELETE", "/item", 405, `{"error":"bad method"}`, "GET, PUT"},
+		{"POST", "/any", 200, `{"error":"","response":{"method":"Post","name":"apple"}}`, ""},
+		{"GET", "/any", 200, `{"error":"","response":{"method":"Any","name":"apple"}}`, ""},
+		{"DELETE", "/any", 200, `{"error":"","response":{"method":"Any","name":"apple"}}`, ""},
+		{"GET", "/unknown", 404, `{"error":"unknown method"}`, ""},
+	}
+
+	for _, api := range apis {
+		ts := httptest.NewServer(api.api)
+		for idx, item := range cases {
+			req, _ := http.NewRequest(item.Method, ts.URL+item.Path, nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("[%s %d] request error: %v", api.name, idx, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != item.Status {
+				t.Errorf("[%s %d] expected http status %v, got %v", api.name, idx, item.Status, resp.StatusCode)
+			}
+			var got, expected interface{}
+			json.Unmarshal(body, &got)
+			json.Unmarshal([]byte(item.Result), &expected)
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("[%s %d] results not match\nGot: %s\nExpected: %s", api.name, idx, body, item.Result)
+			}
+			if got := resp.Header.Get("Allow"); got != item.Allow {
+				t.Errorf("[%s %d] expected Allow %q, got %q", api.name, idx, item.Allow, got)
+			}
+			if got := resp.Header.Get("X-Trace"); got != api.trace {
+				t.Errorf("[%s %d] expected X-Trace %q, got %q", api.name, idx, api.trace, got)
+			}
+		}
+		ts.Close()
+	}
+}
+
+// preflight PUT на общем URL отвечает по настройкам CORS метода PUT
+func TestSharedURLPreflight(t *testing.T) {
+	ts := httptest.NewServer(&ShopApi{})
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodOptions, ts.URL+"/item", nil)
+	req.Header.Set("Origin", "https://admin.example.com")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://admin.example.com" {
+		t.Errorf("expected admin origin, got %q", got)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+type ApiError struct {
+	HTTPStatus int
+	Err        error
+}
+
+func (ae ApiError) Error() string {
+	return ae.Err.Error()
+}
+
+type FeedApi struct {
+	// started закрывается, когда Events начал отдавать события
+	started chan struct{}
+	// stopped закрывается, когда Events увидел отмену контекста
+	stopped chan struct{}
+	// delay - пауза перед каждым событием
+	delay time.Duration
+}
+
+type EventsParams struct {
+	Count int `apivalidator:"min=0,default=3"`
+}
+
+type Event struct {
+	Seq int `json:"seq"`
+}
+
+// apigen:api {"url": "/events"}
+func (srv *FeedApi) Events(ctx context.Context, in EventsParams) (<-chan Event, error) {
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		for i := 1; i <= in.Count; i++ {
+			select {
+			case <-time.After(srv.delay):
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case events <- Event{Seq: i}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if in.Count == 0 {
+			close(srv.started)
+			<-ctx.Done()
+			close(srv.stopped)
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvelope(t *testing.T) {
+	ts := httptest.NewServer(&FeedApi{})
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/events?count=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if got := strings.TrimSpace(string(body)); got != `{"error":"","response":[{"seq":1},{"seq":2}]}` {
+		t.Errorf("unexpected body %s", got)
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	ts := httptest.NewServer(&FeedApi{})
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/events?count=3", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("expected ndjson content type, got %q", ct)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	seq := 0
+	for scanner.Scan() {
+		var ev Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			t.Fatalf("bad line %q: %v", scanner.Text(), err)
+		}
+		seq++
+		if ev.Seq != seq {
+			t.Errorf("expected seq %d, got %d", seq, ev.Seq)
+		}
+	}
+	if seq != 3 {
+		t.Errorf("expected 3 events, got %d", seq)
+	}
+}
+
+func TestNDJSONAccept(t *testing.T) {
+	ts := httptest.NewServer(&FeedApi{})
+	defer ts.Close()
+
+	cases := []struct {
+		Accept      string
+		ContentType string
+	}{
+		{"application/x-ndjson", "application/x-ndjson"},
+		{"application/json;q=0.5, application/x-ndjson", "application/x-ndjson"},
+		{"application/x-ndjson;q=0", "application/json"},
+		{"application/x-ndjson;q=0.5, application/json", "application/json"},
+		{"application/json, application/x-ndjson", "application/json"},
+		{"*/*", "application/json"},
+	}
+	for idx, item := range cases {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/events?count=1", nil)
+		req.Header.Set("Accept", item.Accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if ct := resp.Header.Get("Content-Type"); ct != item.ContentType {
+			t.Errorf("[%d] %q: expected content type %q, got %q", idx, item.Accept, item.ContentType, ct)
+		}
+	}
+}
+
+// поток дольше WriteTimeout сервера не обрывается: дедлайн сдвигается на каждый элемент
+func TestStreamLongerThanWriteTimeout(t *testing.T) {
+	ts := httptest.NewUnstartedServer(&FeedApi{delay: 60 * time.Millisecond})
+	ts.Config.WriteTimeout = 100 * time.Millisecond
+	ts.Start()
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/events?count=4", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		lines++
+	}
+	if lines != 4 {
+		t.Errorf("expected 4 events, got %d (%v)", lines, scanner.Err())
+	}
+}
+
+// поток без конца: после отключения клиента метод должен увидеть отмену контекста
+func TestClientDisconnect(t *testing.T) {
+	api := &FeedApi{started: make(chan struct{}), stopped: make(chan struct{})}
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/events?count=0", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	<-api.started
+	cancel()
+	select {
+	case <-api.stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("method did not see client disconnect")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+type ApiError struct {
+	HTTPStatus int
+	Err        error
+	Code       string
+}
+
+func (ae ApiError) Error() string {
+	return ae.Err.Error()
+}
+
+func (ae ApiError) ErrorCode() string {
+	return ae.Code
+}
+
+type SlowApi struct {
+	logger *log.Logger
+	// started закрывается, когда Wait начал ждать
+	started chan struct{}
+}
+
+type WaitParams struct {
+	Mode string `apivalidator:"enum=ctx|deadline|own,default=ctx"`
+}
+
+type Waited struct {
+	Deadline bool `json:"deadline"`
+}
+
+// ждёт, пока контекст не закончится
+// apigen:api {"url": "/wait", "timeout": "50ms"}
+func (srv *SlowApi) Wait(ctx context.Context, in WaitParams) (*Waited, error) {
+	_, hasDeadline := ctx.Deadline()
+	if in.Mode == "deadline" {
+		return &Waited{Deadline: hasDeadline}, nil
+	}
+	if srv.started != nil {
+		close(srv.started)
+	}
+	<-ctx.Done()
+	if in.Mode == "own" {
+		return nil, ApiError{HTTPStatus: http.StatusServiceUnavailable, Err: errors.New("backend is slow"), Code: "backend_slow"}
+	}
+	return nil, ctx.Err()
+}
+
+// без таймаута - контекст запроса как есть
+// apigen:api {"url": "/free"}
+func (srv *SlowApi) Free(ctx context.Context, in WaitParams) (*Waited, error) {
+	_, hasDeadline := ctx.Deadline()
+	time.Sleep(time.Millisecond)
+	return &Waited{Deadline: hasDeadline}, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, url string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, strings.TrimSpace(string(body))
+}
+
+func TestDeadline(t *testing.T) {
+	ts := httptest.NewServer(&SlowApi{})
+	defer ts.Close()
+
+	cases := []struct {
+		query  string
+		status int
+		body   string
+	}{
+		{"/wait?mode=deadline", http.StatusOK, `{"error":"","response":{"deadline":true}}`},
+		{"/free", http.StatusOK, `{"error":"","response":{"deadline":false}}`},
+		{"/wait", http.StatusGatewayTimeout, `{"code":"timeout","error":"timeout"}`},
+		// свою ошибку метод по-прежнему выбирает сам
+		{"/wait?mode=own", http.StatusServiceUnavailable, `{"code":"backend_slow","error":"backend is slow"}`},
+	}
+	for _, tc := range cases {
+		start := time.Now()
+		status, body := get(t, ts.URL+tc.query)
+		if status != tc.status || body != tc.body {
+			t.Errorf("[%s] expected %d %s, got %d %s", tc.query, tc.status, tc.body, status, body)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("[%s] took %v, timeout not applied", tc.query, elapsed)
+		}
+	}
+}
+
+func TestClientGone(t *testing.T) {
+	var logs bytes.Buffer
+	api := &SlowApi{logger: log.New(&logs, "", 0), started: make(chan struct{})}
+	req := httptest.NewRequest(http.MethodGet, "/wait", nil)
+	ctx, cancel := context.WithCancel(req.Context())
+	req = req.WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	go func() {
+		<-api.started
+		cancel()
+	}()
+	api.ServeHTTP(w, req)
+
+	if w.Body.Len() != 0 {
+		t.Errorf("nobody to answer, but got %s", w.Body.String())
+	}
+	if !strings.Contains(logs.String(), "499 client closed request GET /wait: context canceled") {
+		t.Errorf("expected 499 in log, got %q", logs.String())
+	}
+}
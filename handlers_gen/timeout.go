@@ -0,0 +1,49 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+// parseTimeout разбирает "timeout": "2s" в формате time.ParseDuration
+func parseTimeout(method *MethodMeta) {
+	if method.Timeout == "" {
+		return
+	}
+	d, err := time.ParseDuration(method.Timeout)
+	if err != nil || d <= 0 {
+		log.Fatalf("%s.%s: bad timeout %q, expected like \"2s\" or \"500ms\"", method.ApiName, method.Name, method.Timeout)
+	}
+	method.TimeoutDuration = d
+}
+
+// TimeoutLiteral - таймаут выражением на time, как написал бы человек: 2 * time.Second
+func (method *MethodMeta) TimeoutLiteral() string {
+	d := method.TimeoutDuration
+	for _, unit := range []struct {
+		d    time.Duration
+		name string
+	}{
+		{time.Hour, "time.Hour"},
+		{time.Minute, "time.Minute"},
+		{time.Second, "time.Second"},
+		{time.Millisecond, "time.Millisecond"},
+	} {
+		if d%unit.d == 0 {
+			return strconv.FormatInt(int64(d/unit.d), 10) + " * " + unit.name
+		}
+	}
+	return "time.Duration(" + strconv.FormatInt(int64(d), 10) + ")"
+}
+
+func hasTimeouts(services []*ServiceMeta) bool {
+	for _, srv := range services {
+		for _, method := range srv.Methods {
+			if method.Timeout != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
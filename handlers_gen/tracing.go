@@ -0,0 +1,232 @@
+package main
+
+import (
+	"text/template"
+)
+
+// поле, через которое обёртки начинают span на запрос
+const tracer = "Tracer"
+
+// Tracer - выражение с трейсером для обёрток
+func (srv *ServiceMeta) Tracer() string {
+	return "h." + srv.TracerField
+}
+
+func hasTracing(services []*ServiceMeta) bool {
+	for _, srv := range services {
+		if srv.TracerField != "" {
+			return true
+		}
+	}
+	return false
+}
+
+var tracingTpl = template.Must(template.New("tracingTpl").Funcs(funcs).Parse(`
+// SpanContext - то, что передаётся между сервисами в W3C traceparent
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Traceparent - значение заголовка traceparent, версия 00
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(sc.TraceID[:]) + "-" + hex.EncodeToString(sc.SpanID[:]) + "-" + flags
+}
+
+// ParseTraceparent разбирает заголовок traceparent. Версии новее 00 можно
+// разбирать по первым четырём полям, больше полей у 00 быть не может
+func ParseTraceparent(header string) (SpanContext, bool) {
+	var sc SpanContext
+	header = strings.TrimSpace(header)
+	parts := strings.Split(header, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	version, errVersion := hex.DecodeString(parts[0])
+	traceID, errTrace := hex.DecodeString(parts[1])
+	spanID, errSpan := hex.DecodeString(parts[2])
+	flags, errFlags := hex.DecodeString(parts[3])
+	if errVersion != nil || errTrace != nil || errSpan != nil || errFlags != nil ||
+		len(version) != 1 || len(traceID) != 16 || len(spanID) != 8 || len(flags) != 1 ||
+		strings.ToLower(header) != header {
+		return sc, false
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.IsValid()
+}
+
+// Span - запрос к одному методу API
+type Span interface {
+	SpanContext() SpanContext
+	SetAttribute(key string, value interface{})
+	AddEvent(name string, attrs map[string]interface{})
+	End()
+}
+
+// Tracer начинает span. parent - из traceparent запроса, если он был.
+// Поле этого типа в структуре API включает трейсинг, nil - span'ы ничего не пишут.
+// Адаптер к OpenTelemetry - пара десятков строк поверх trace.Tracer
+type Tracer interface {
+	Start(ctx context.Context, name string, parent SpanContext) Span
+}
+
+type apiSpanKey struct{}
+
+// ContextWithSpan - span запроса в контексте, его видят методы API
+func ContextWithSpan(ctx context.Context, span Span) context.Context {
+	return context.WithValue(ctx, apiSpanKey{}, span)
+}
+
+// SpanFromContext - span запроса или пустой span, если его нет
+func SpanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(apiSpanKey{}).(Span); ok {
+		return span
+	}
+	return noopSpan{}
+}
+
+// InjectTraceparent пишет traceparent span'а из ctx в заголовки исходящего запроса
+func InjectTraceparent(ctx context.Context, header http.Header) {
+	if sc := SpanFromContext(ctx).SpanContext(); sc.IsValid() {
+		header.Set("traceparent", sc.Traceparent())
+	}
+}
+
+// noopSpan ничего не пишет, но отдаёт родителя - trace не рвётся
+type noopSpan struct {
+	parent SpanContext
+}
+
+func (s noopSpan) SpanContext() SpanContext                      { return s.parent }
+func (noopSpan) SetAttribute(key string, value interface{})      {}
+func (noopSpan) AddEvent(name string, attrs map[string]interface{}) {}
+func (noopSpan) End()                                            {}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string, parent SpanContext) Span {
+	return noopSpan{parent: parent}
+}
+
+// SpanEvent - событие внутри span'а
+type SpanEvent struct {
+	Name       string
+	Attributes map[string]interface{}
+}
+
+// RecordedSpan - законченный span MemoryTracer
+type RecordedSpan struct {
+	Name        string
+	SpanContext SpanContext
+	Parent      SpanContext
+	Attributes  map[string]interface{}
+	Events      []SpanEvent
+}
+
+// MemoryTracer складывает законченные span'ы в память - для тестов
+type MemoryTracer struct {
+	mu    sync.Mutex
+	spans []RecordedSpan
+}
+
+func NewMemoryTracer() *MemoryTracer {
+	return &MemoryTracer{}
+}
+
+func (t *MemoryTracer) Start(ctx context.Context, name string, parent SpanContext) Span {
+	sc := SpanContext{TraceID: parent.TraceID, Sampled: true}
+	if !parent.IsValid() {
+		rand.Read(sc.TraceID[:])
+	}
+	rand.Read(sc.SpanID[:])
+	return &memorySpan{tracer: t, span: RecordedSpan{
+		Name:        name,
+		SpanContext: sc,
+		Parent:      parent,
+		Attributes:  map[string]interface{}{},
+	}}
+}
+
+// Spans - законченные span'ы в порядке End
+func (t *MemoryTracer) Spans() []RecordedSpan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]RecordedSpan(nil), t.spans...)
+}
+
+type memorySpan struct {
+	tracer *MemoryTracer
+	span   RecordedSpan
+}
+
+func (s *memorySpan) SpanContext() SpanContext {
+	return s.span.SpanContext
+}
+
+func (s *memorySpan) SetAttribute(key string, value interface{}) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.span.Attributes[key] = value
+}
+
+func (s *memorySpan) AddEvent(name string, attrs map[string]interface{}) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.span.Events = append(s.span.Events, SpanEvent{Name: name, Attributes: attrs})
+}
+
+func (s *memorySpan) End() {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.tracer.spans = append(s.tracer.spans, s.span)
+}
+
+// startApiSpan начинает span обёртки от traceparent запроса и кладёт его в контекст
+func startApiSpan(tracer Tracer, r *http.Request, api, endpoint string) (*http.Request, Span) {
+	if tracer == nil {
+		tracer = noopTracer{}
+	}
+	parent, _ := ParseTraceparent(r.Header.Get("traceparent"))
+	span := tracer.Start(r.Context(), api+"."+endpoint, parent)
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("url.path", r.URL.Path)
+	span.SetAttribute("apigen.api", api)
+	span.SetAttribute("apigen.endpoint", endpoint)
+	return r.WithContext(ContextWithSpan(r.Context(), span)), span
+}
+
+// endApiSpan вызывается через defer: статус ответа, код ApiError и событие
+// с ошибкой - validation_error для параметров, error для остальных
+func endApiSpan(span Span, rec *apiRecorder, r *http.Request) {
+	status := rec.finalStatus(r)
+	span.SetAttribute("http.response.status_code", status)
+	if rec.code != "" {
+		span.SetAttribute("apigen.error_code", rec.code)
+	}
+	switch {
+	case rec.invalidParam != "":
+		span.AddEvent("validation_error", map[string]interface{}{
+			"param":   rec.invalidParam,
+			"code":    rec.code,
+			"message": rec.err.Error(),
+		})
+	case rec.err != nil:
+		span.AddEvent("error", map[string]interface{}{
+			"code":    rec.code,
+			"message": rec.err.Error(),
+		})
+	}
+	span.End()
+}
+`))
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// brokenStore - хранилище, до которого не достучаться
+type brokenStore struct {
+	UserStore
+}
+
+func (brokenStore) List(ctx context.Context, afterID uint64, limit int) ([]*User, error) {
+	return nil, errors.New("store is down")
+}
+
+func healthRequest(t *testing.T, handler http.Handler, url string) (int, map[string]interface{}) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s: bad json %q: %v", url, w.Body.String(), err)
+	}
+	return w.Code, body
+}
+
+func TestHealth(t *testing.T) {
+	cases := []struct {
+		name    string
+		handler http.Handler
+		url     string
+		status  int
+		body    map[string]interface{}
+	}{
+		{"healthz", NewMyApi(testAuth), "/user/healthz", http.StatusOK, map[string]interface{}{"status": "ok"}},
+		{"ready", NewMyApi(testAuth), "/user/readyz", http.StatusOK, map[string]interface{}{"status": "ready"}},
+		{"store is down", NewMyApiWithStore(brokenStore{}, testAuth), "/user/readyz", http.StatusServiceUnavailable, map[string]interface{}{"status": "unavailable", "error": "store is down"}},
+		{"alive with store down", NewMyApiWithStore(brokenStore{}, testAuth), "/user/healthz", http.StatusOK, map[string]interface{}{"status": "ok"}},
+		{"no Ready method", NewOtherApi(testAuth), "/user/readyz", http.StatusOK, map[string]interface{}{"status": "ready"}},
+	}
+	for _, tc := range cases {
+		status, body := healthRequest(t, tc.handler, tc.url)
+		if status != tc.status {
+			t.Errorf("[%s] expected status %d, got %d", tc.name, tc.status, status)
+		}
+		for key, value := range tc.body {
+			if body[key] != value {
+				t.Errorf("[%s] expected %s=%v, got %v", tc.name, key, value, body[key])
+			}
+		}
+	}
+}
+
+func TestHealthMethods(t *testing.T) {
+	api := NewMyApi(testAuth)
+	for _, tc := range []struct {
+		method string
+		status int
+	}{
+		{http.MethodGet, http.StatusOK},
+		{http.MethodHead, http.StatusOK},
+		{http.MethodPost, http.StatusMethodNotAllowed},
+		{http.MethodDelete, http.StatusMethodNotAllowed},
+	} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(tc.method, "/user/healthz", nil))
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.method, tc.status, w.Code)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	_, my := healthRequest(t, NewMyApi(testAuth), "/user/version")
+	_, other := healthRequest(t, NewOtherApi(testAuth), "/user/version")
+	if my["generator"] != apiGeneratorVersion || my["generator"] == "" {
+		t.Errorf("unexpected generator version %v", my["generator"])
+	}
+	hash, _ := my["annotations"].(string)
+	if len(hash) != 64 {
+		t.Errorf("expected sha256 of annotations, got %q", hash)
+	}
+	if my["annotations"] == other["annotations"] {
+		t.Errorf("MyApi and OtherApi have different annotations, but the same hash %v", hash)
+	}
+}
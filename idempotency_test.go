@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func createWithKey(t *testing.T, ts *httptest.Server, key, query string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+ApiUserCreate, strings.NewReader(query))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Auth", "100500")
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, strings.TrimSpace(string(body))
+}
+
+func TestCreateIdempotencyKey(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi(testAuth))
+	defer ts.Close()
+	query := "login=mobile_user_1&full_name=Mobile"
+
+	first, firstBody := createWithKey(t, ts, "retry-1", query)
+	if first.StatusCode != http.StatusOK || firstBody != `{"error":"","response":{"id":43}}` {
+		t.Fatalf("unexpected first response %d %s", first.StatusCode, firstBody)
+	}
+
+	// клиент не дождался ответа и повторил - тот же ответ, а не 409
+	retry, retryBody := createWithKey(t, ts, "retry-1", query)
+	if retry.StatusCode != http.StatusOK || retryBody != firstBody {
+		t.Errorf("expected replay of %s, got %d %s", firstBody, retry.StatusCode, retryBody)
+	}
+	if retry.Header.Get("Idempotent-Replayed") != "true" {
+		t.Error("expected Idempotent-Replayed header on retry")
+	}
+	if retry.Header.Get("Content-Type") != first.Header.Get("Content-Type") {
+		t.Errorf("expected saved headers, got %v", retry.Header)
+	}
+
+	// тот же ключ с другим телом - ошибка клиента
+	reused, reusedBody := createWithKey(t, ts, "retry-1", "login=mobile_user_2")
+	if reused.StatusCode != http.StatusUnprocessableEntity || !strings.Contains(reusedBody, "idempotency_key_reused") {
+		t.Errorf("expected 422 idempotency_key_reused, got %d %s", reused.StatusCode, reusedBody)
+	}
+
+	// без ключа повтор - обычный конфликт
+	plain, plainBody := createWithKey(t, ts, "", query)
+	if plain.StatusCode != http.StatusConflict || !strings.Contains(plainBody, "user_exists") {
+		t.Errorf("expected 409 without key, got %d %s", plain.StatusCode, plainBody)
+	}
+}
+
+// ключи разных клиентов не пересекаются: чужой ключ - не повтор чужого ответа
+func TestIdempotencyKeyPerPrincipal(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi(AuthSecrets{"alice": "a-secret", "bob": "b-secret"}))
+	defer ts.Close()
+
+	for i, secret := range []string{"a-secret", "b-secret"} {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+ApiUserCreate, strings.NewReader("login=shared_key_"+string(rune('a'+i))))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Auth", secret)
+		req.Header.Set("Idempotency-Key", "shared")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Idempotent-Replayed") != "" {
+			t.Errorf("[%d] expected own create, got %d replayed=%q", i, resp.StatusCode, resp.Header.Get("Idempotent-Replayed"))
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBodyLimits(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi(testAuth))
+	defer ts.Close()
+
+	big := "login=big_body_user&full_name=" + strings.Repeat("x", 70<<10)
+	cases := []Case{
+		Case{ // тело больше 64KB
+			Path:   ApiUserCreate,
+			Method: http.MethodPost,
+			Query:  big,
+			Auth:   true,
+			Status: http.StatusRequestEntityTooLarge,
+			Result: CR{
+				"error":   "request body too large",
+				"code":    "body_too_large",
+				"details": CR{"limit": 65536},
+			},
+		},
+		Case{ // опечатка в имени параметра не проходит молча
+			Path:   ApiUserCreate,
+			Method: http.MethodPost,
+			Query:  "login=strict_user_1&fullname=Typo",
+			Auth:   true,
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error":   "unknown param",
+				"code":    "unknown_param",
+				"details": CR{"param": "fullname"},
+			},
+		},
+		Case{ // в query тоже
+			Path:   ApiUserUpdate + "?debug=1",
+			Method: http.MethodPost,
+			Query:  "login=rvasily",
+			Auth:   true,
+			Status: http.StatusBadRequest,
+			Result: CR{
+				"error":   "unknown param",
+				"code":    "unknown_param",
+				"details": CR{"param": "debug"},
+			},
+		},
+		Case{ // Profile не строгий
+			Path:   ApiUserProfile,
+			Query:  "login=rvasily&utm_source=mail",
+			Status: http.StatusOK,
+			Result: CR{
+				"error": "",
+				"response": CR{
+					"id":        42,
+					"login":     "rvasily",
+					"full_name": "Vasily Romanov",
+					"status":    20,
+					"version":   1,
+				},
+			},
+		},
+	}
+	runTests(t, ts, cases)
+
+	// с Idempotency-Key тело читается раньше формы - предел тот же
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+ApiUserCreate, strings.NewReader(big))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Auth", "100500")
+	req.Header.Set("Idempotency-Key", "big")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413 with idempotency key, got %d", resp.StatusCode)
+	}
+}
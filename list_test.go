@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUserListPages(t *testing.T) {
+	api := NewMyApi(testAuth)
+	for i := 0; i < 4; i++ {
+		if _, err := api.store.Create(context.Background(), &User{Login: fmt.Sprintf("list_user_%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+
+	var ids []uint64
+	cursor := ""
+	for page := 0; ; page++ {
+		if page > 5 {
+			t.Fatal("pagination does not stop")
+		}
+		resp, err := client.Get(ts.URL + "/user/list?limit=2&cursor=" + cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Error      string  `json:"error"`
+			Response   []*User `json:"response"`
+			NextCursor string  `json:"next_cursor"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("page %d: status %d, err %v", page, resp.StatusCode, err)
+		}
+		if len(body.Response) > 2 {
+			t.Fatalf("page %d: limit ignored, got %d users", page, len(body.Response))
+		}
+		for _, user := range body.Response {
+			ids = append(ids, user.ID)
+		}
+		if body.NextCursor == "" {
+			break
+		}
+		cursor = body.NextCursor
+	}
+
+	expected := []uint64{42, 43, 44, 45, 46}
+	if fmt.Sprint(ids) != fmt.Sprint(expected) {
+		t.Errorf("expected ids %v, got %v", expected, ids)
+	}
+}
+
+func TestUserListNDJSON(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi(testAuth))
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/user/list", nil)
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("expected ndjson content type, got %q", ct)
+	}
+	if _, ok := resp.Header["X-Next-Cursor"]; !ok {
+		t.Error("expected X-Next-Cursor header")
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	var logins []string
+	for scanner.Scan() {
+		var user User
+		if err := json.Unmarshal(scanner.Bytes(), &user); err != nil {
+			t.Fatalf("bad line %q: %v", scanner.Text(), err)
+		}
+		logins = append(logins, user.Login)
+	}
+	if len(logins) != 1 || logins[0] != "rvasily" {
+		t.Errorf("unexpected users %v", logins)
+	}
+}
+
+func TestUserListBadCursor(t *testing.T) {
+	ts := httptest.NewServer(NewMyApi(testAuth))
+	defer ts.Close()
+
+	resp, err := client.Get(ts.URL + "/user/list?cursor=abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body CR
+	json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest || body["code"] != "bad_cursor" {
+		t.Errorf("expected 400 bad_cursor, got %d %v", resp.StatusCode, body)
+	}
+}
@@ -3,17 +3,60 @@ package main
 // это программа для которой ваш кодогенератор будет писать код
 // запускать через go test -v, как обычно
 
-// этот код закомментирован чтобы он не светился в тестовом покрытии
-
 import (
-	"fmt"
-	"net/http"
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	// будет вызван метод ServeHTTP у структуры MyApi
-	http.Handle("/user/", NewMyApi())
+	level := new(slog.LevelVar)
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	// ошибки настроек - при запуске, а не на первом запросе
+	cfg, err := loadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		logger.Error("bad config", "error", err)
+		os.Exit(2)
+	}
+	logLevel, _ := cfg.logLevel()
+	level.Set(logLevel)
+	tlsCfg, err := cfg.Server.tlsConfig()
+	if err != nil {
+		logger.Error("bad config", "error", err)
+		os.Exit(2)
+	}
+	handler, closeStore, err := newHandler(cfg, logger)
+	if err != nil {
+		logger.Error("bad config", "error", err)
+		os.Exit(2)
+	}
+
+	// SIGINT и SIGTERM - дорабатываем начатые запросы и выходим
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ln, err := net.Listen("tcp", cfg.Server.Addr)
+	if err != nil {
+		logger.Error("listen", "error", err)
+		closeStore()
+		os.Exit(1)
+	}
+	logger.Info("starting server", "addr", ln.Addr().String(), "tls", tlsCfg != nil, "mtls", tlsCfg != nil && tlsCfg.ClientCAs != nil)
 
-	fmt.Println("starting server at :8080")
-	http.ListenAndServe(":8080", nil)
+	srv := newServer(cfg.Server, handler, logger)
+	srv.TLSConfig = tlsCfg
+	err = runServer(ctx, srv, ln, cfg.Server.ShutdownTimeout.Duration)
+	// журнал закрывается, когда запросов в работе уже нет
+	if closeErr := closeStore(); closeErr != nil {
+		logger.Error("close store", "error", closeErr)
+	}
+	if err != nil {
+		logger.Error("server stopped", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("server stopped")
 }
@@ -18,6 +18,8 @@ func CheckoutDummy(w http.ResponseWriter, r *http.Request) {
 
 var (
 	client = &http.Client{Timeout: time.Second}
+	// testAuth - секрет, с которым тесты ходят в методы с "auth": true
+	testAuth = AuthSecrets{"test": "100500"}
 )
 
 type Case struct {
@@ -38,7 +40,7 @@ const (
 type CR map[string]interface{}
 
 func TestMyApi(t *testing.T) {
-	ts := httptest.NewServer(NewMyApi())
+	ts := httptest.NewServer(NewMyApi(testAuth))
 
 	cases := []Case{
 		Case{ // успешный запрос
@@ -52,6 +54,7 @@ func TestMyApi(t *testing.T) {
 					"login":     "rvasily",
 					"full_name": "Vasily Romanov",
 					"status":    20,
+					"version":   1,
 				},
 			},
 		},
@@ -67,6 +70,7 @@ func TestMyApi(t *testing.T) {
 					"login":     "rvasily",
 					"full_name": "Vasily Romanov",
 					"status":    20,
+					"version":   1,
 				},
 			},
 		},
@@ -75,7 +79,9 @@ func TestMyApi(t *testing.T) {
 			Query:  "",
 			Status: http.StatusBadRequest,
 			Result: CR{
-				"error": "login must me not empty",
+				"error":   "login must me not empty",
+				"code":    "param_required",
+				"details": CR{"param": "login"},
 			},
 		},
 		Case{ // получили ошибку общего назначения - ваш код сам подставил 500
@@ -91,7 +97,9 @@ func TestMyApi(t *testing.T) {
 			Query:  "login=not_exist_user",
 			Status: http.StatusNotFound,
 			Result: CR{
-				"error": "user not exist",
+				"error":   "user not exist",
+				"code":    "user_not_found",
+				"details": CR{"login": "not_exist_user"},
 			},
 		},
 		// ------
@@ -101,6 +109,7 @@ func TestMyApi(t *testing.T) {
 			Status: http.StatusNotFound,
 			Result: CR{
 				"error": "unknown method",
+				"code":  "unknown_method",
 			},
 		},
 		// ------
@@ -128,6 +137,7 @@ func TestMyApi(t *testing.T) {
 					"login":     "mr.moderator",
 					"full_name": "Ivan_Ivanov",
 					"status":    10,
+					"version":   1,
 				},
 			},
 		},
@@ -140,6 +150,7 @@ func TestMyApi(t *testing.T) {
 			Auth:   true,
 			Result: CR{
 				"error": "bad method",
+				"code":  "bad_method",
 			},
 		},
 		Case{
@@ -150,6 +161,7 @@ func TestMyApi(t *testing.T) {
 			Auth:   false,
 			Result: CR{
 				"error": "unauthorized",
+				"code":  "unauthorized",
 			},
 		},
 		Case{
@@ -159,7 +171,9 @@ func TestMyApi(t *testing.T) {
 			Status: http.StatusConflict,
 			Auth:   true,
 			Result: CR{
-				"error": "user mr.moderator exist",
+				"error":   "user mr.moderator exist",
+				"code":    "user_exists",
+				"details": CR{"login": "mr.moderator"},
 			},
 		},
 		Case{
@@ -169,7 +183,9 @@ func TestMyApi(t *testing.T) {
 			Status: http.StatusBadRequest,
 			Auth:   true,
 			Result: CR{
-				"error": "login must me not empty",
+				"error":   "login must me not empty",
+				"code":    "param_required",
+				"details": CR{"param": "login"},
 			},
 		},
 		Case{
@@ -179,7 +195,9 @@ func TestMyApi(t *testing.T) {
 			Status: http.StatusBadRequest,
 			Auth:   true,
 			Result: CR{
-				"error": "login len must be >= 10",
+				"error":   "login len must be >= 10",
+				"code":    "param_below_min",
+				"details": CR{"param": "login", "min": 10},
 			},
 		},
 		Case{
@@ -189,7 +207,9 @@ func TestMyApi(t *testing.T) {
 			Status: http.StatusBadRequest,
 			Auth:   true,
 			Result: CR{
-				"error": "age must be int",
+				"error":   "age must be int",
+				"code":    "param_not_int",
+				"details": CR{"param": "age"},
 			},
 		},
 		Case{
@@ -199,7 +219,9 @@ func TestMyApi(t *testing.T) {
 			Status: http.StatusBadRequest,
 			Auth:   true,
 			Result: CR{
-				"error": "age must be >= 0",
+				"error":   "age must be >= 0",
+				"code":    "param_below_min",
+				"details": CR{"param": "age", "min": 0},
 			},
 		},
 		Case{
@@ -209,7 +231,9 @@ func TestMyApi(t *testing.T) {
 			Status: http.StatusBadRequest,
 			Auth:   true,
 			Result: CR{
-				"error": "age must be <= 128",
+				"error":   "age must be <= 128",
+				"code":    "param_above_max",
+				"details": CR{"param": "age", "max": 128},
 			},
 		},
 		Case{
@@ -219,7 +243,9 @@ func TestMyApi(t *testing.T) {
 			Status: http.StatusBadRequest,
 			Auth:   true,
 			Result: CR{
-				"error": "status must be one of [user, moderator, admin]",
+				"error":   "status must be one of [user, moderator, admin]",
+				"code":    "param_not_in_enum",
+				"details": CR{"param": "status", "enum": []string{"user", "moderator", "admin"}},
 			},
 		},
 		Case{ // status по-умолчанию
@@ -251,7 +277,7 @@ func TestMyApi(t *testing.T) {
 }
 
 func TestOtherApi(t *testing.T) {
-	ts := httptest.NewServer(NewOtherApi())
+	ts := httptest.NewServer(NewOtherApi(testAuth))
 
 	cases := []Case{
 		Case{
@@ -261,7 +287,9 @@ func TestOtherApi(t *testing.T) {
 			Status: http.StatusBadRequest,
 			Auth:   true,
 			Result: CR{
-				"error": "class must be one of [warrior, sorcerer, rouge]",
+				"error":   "class must be one of [warrior, sorcerer, rouge]",
+				"code":    "param_not_in_enum",
+				"details": CR{"param": "class", "enum": []string{"warrior", "sorcerer", "rouge"}},
 			},
 		},
 		Case{
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrapeMetrics - значения метрик по строке "имя{метки}"
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	t.Helper()
+	w := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", ct)
+	}
+
+	metrics := map[string]float64{}
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("bad metrics line %q", line)
+		}
+		metrics[line[:i]] = value
+	}
+	return metrics
+}
+
+func TestMetrics(t *testing.T) {
+	before := scrapeMetrics(t)
+
+	myApi, otherApi := NewMyApi(testAuth), NewOtherApi(testAuth)
+	requests := []struct {
+		handler http.Handler
+		url     string
+		auth    bool
+	}{
+		{myApi, ApiUserProfile + "?login=rvasily", false},
+		{myApi, ApiUserProfile + "?login=rvasily", false},
+		{myApi, ApiUserProfile + "?login=nobody", false},
+		{myApi, ApiUserProfile, false},
+		{otherApi, ApiUserCreate + "?username=ab", true},
+	}
+	for _, req := range requests {
+		r := httptest.NewRequest(http.MethodPost, req.url, nil)
+		if req.auth {
+			r.Header.Set("X-Auth", "100500")
+		}
+		req.handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	after := scrapeMetrics(t)
+	expected := map[string]float64{
+		`apigen_requests_total{api="MyApi",endpoint="Profile",status="200"}`:                        2,
+		`apigen_requests_total{api="MyApi",endpoint="Profile",status="404"}`:                        1,
+		`apigen_requests_total{api="MyApi",endpoint="Profile",status="400"}`:                        1,
+		`apigen_errors_total{api="MyApi",endpoint="Profile",status="404",code="user_not_found"}`:    1,
+		`apigen_errors_total{api="MyApi",endpoint="Profile",status="400",code="param_required"}`:    1,
+		`apigen_errors_total{api="OtherApi",endpoint="Create",status="400",code="param_below_min"}`: 1,
+		`apigen_request_duration_seconds_count{api="MyApi",endpoint="Profile"}`:                     4,
+		`apigen_request_duration_seconds_bucket{api="MyApi",endpoint="Profile",le="+Inf"}`:          4,
+		`apigen_request_duration_seconds_count{api="OtherApi",endpoint="Create"}`:                   1,
+	}
+	for name, delta := range expected {
+		if got := after[name] - before[name]; got != delta {
+			t.Errorf("%s: expected +%v, got +%v", name, delta, got)
+		}
+	}
+
+	// гистограмма накопительная
+	prev := -1.0
+	for _, le := range []string{"0.005", "0.1", "1", "10", "+Inf"} {
+		value := after[`apigen_request_duration_seconds_bucket{api="MyApi",endpoint="Profile",le="`+le+`"}`]
+		if value < prev {
+			t.Errorf("bucket le=%s is %v, less than previous %v", le, value, prev)
+		}
+		prev = value
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// newHandler - все API процесса на одном mux. У OtherApi те же URL, что
+// у MyApi, поэтому он живёт под /other/. closeStore закрывает журнал
+// пользователей, его вызывают после остановки сервера
+func newHandler(cfg config, logger *slog.Logger) (handler http.Handler, closeStore func() error, err error) {
+	api := NewMyApi(cfg.Auth)
+	closeStore = func() error { return nil }
+	if cfg.Store.Path != "" {
+		store, err := OpenFileUserStore(cfg.Store.Path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("store.path: %w", err)
+		}
+		api, closeStore = NewMyApiWithStore(store, cfg.Auth), store.Close
+	}
+
+	user, err := api.WithLogger(logger).
+		WithRateLimits(cfg.rateLimits()).
+		WithCORS(CORSOrigins(cfg.CORS.Origins)).
+		Handler()
+	if err != nil {
+		closeStore()
+		return nil, nil, err
+	}
+	other, err := NewOtherApi(cfg.Auth).WithLogger(logger).Handler()
+	if err != nil {
+		closeStore()
+		return nil, nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/user/", user)
+	mux.Handle("/other/", http.StripPrefix("/other", other))
+	mux.Handle("/metrics", MetricsHandler())
+	return mux, closeStore, nil
+}
+
+// tlsConfig - *tls.Config из файлов настроек, nil - сервер без https.
+// Файлы читаются при запуске, чтобы ошибка в пути не ждала первого клиента
+func (cfg serverConfig) tlsConfig() (*tls.Config, error) {
+	if cfg.TLS.Cert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLS.Cert, cfg.TLS.Key)
+	if err != nil {
+		return nil, fmt.Errorf("server.tls: %w", err)
+	}
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.TLS.ClientCA == "" {
+		return tlsCfg, nil
+	}
+	data, err := os.ReadFile(cfg.TLS.ClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("server.tls.client_ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("server.tls.client_ca: no certificates in %s", cfg.TLS.ClientCA)
+	}
+	tlsCfg.ClientCAs = pool
+	// сертификат нужен только методам с "auth": "mtls", остальные
+	// открыты и без него. Присланный сертификат проверяется всегда
+	tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsCfg, nil
+}
+
+func newServer(cfg serverConfig, handler http.Handler, logger *slog.Logger) *http.Server {
+	return &http.Server{
+		Addr:              cfg.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout.Duration,
+		ReadTimeout:       cfg.ReadTimeout.Duration,
+		WriteTimeout:      cfg.WriteTimeout.Duration,
+		IdleTimeout:       cfg.IdleTimeout.Duration,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+}
+
+// runServer обслуживает ln, пока не отменят ctx, потом перестаёт принимать
+// соединения и ждёт запросы в работе не дольше drain
+func runServer(ctx context.Context, srv *http.Server, ln net.Listener, drain time.Duration) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// сертификаты уже в TLSConfig
+			serveErr <- srv.ServeTLS(ln, "", "")
+			return
+		}
+		serveErr <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		// не дождались - рвём оставшиеся соединения
+		srv.Close()
+		return fmt.Errorf("shutdown: %w", err)
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testHandler - newHandler, хранилище закрывается в конце теста
+func testHandler(t *testing.T, cfg config) http.Handler {
+	t.Helper()
+	handler, closeStore, err := newHandler(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { closeStore() })
+	return handler
+}
+
+func TestHandlerMountsAll(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Auth = AuthSecrets{"test": "secret"}
+	ts := httptest.NewServer(testHandler(t, cfg))
+	defer ts.Close()
+
+	cases := []struct {
+		path   string
+		status int
+	}{
+		{"/user/profile?login=rvasily", http.StatusOK},
+		// дошли до OtherApi: create у него только POST
+		{"/other/user/create?username=warrior&level=10", http.StatusNotAcceptable},
+		{"/other/user/healthz", http.StatusOK},
+		{"/metrics", http.StatusOK},
+	}
+	for _, tc := range cases {
+		resp, err := client.Get(ts.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.path, tc.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestHandlerFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.log")
+	env := map[string]string{"API_AUTH_SECRETS": "test:secret", "API_STORE_PATH": path}
+	cfg, err := loadConfig(nil, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler, closeStore, err := newHandler(cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(handler)
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/user/create?login=stored_user&age=20", nil)
+	req.Header.Set("X-Auth", "secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	ts.Close()
+	if err := closeStore(); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("create: expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	// после перезапуска пользователь на месте
+	ts = httptest.NewServer(testHandler(t, cfg))
+	defer ts.Close()
+	resp, err = client.Get(ts.URL + "/user/profile?login=stored_user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("profile after restart: expected %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
+// заголовки ждём меньше, чем весь запрос
+func TestServerTimeouts(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cases := []struct {
+		name       string
+		args       []string
+		env        map[string]string
+		readHeader time.Duration
+		read       time.Duration
+	}{
+		{"defaults", nil, nil, 2 * time.Second, 5 * time.Second},
+		{"env and flags", []string{"-read-timeout", "30s"}, map[string]string{"API_READ_HEADER_TIMEOUT": "1s"}, time.Second, 30 * time.Second},
+	}
+	for _, tc := range cases {
+		env := map[string]string{"API_AUTH_SECRETS": "test:secret"}
+		for name, value := range tc.env {
+			env[name] = value
+		}
+		cfg, err := loadConfig(tc.args, func(name string) string { return env[name] })
+		if err != nil {
+			t.Fatalf("[%s] %v", tc.name, err)
+		}
+		srv := newServer(cfg.Server, http.NotFoundHandler(), logger)
+		if srv.ReadHeaderTimeout != tc.readHeader || srv.ReadTimeout != tc.read {
+			t.Errorf("[%s] expected read header %v and read %v, got %v and %v", tc.name, tc.readHeader, tc.read, srv.ReadHeaderTimeout, srv.ReadTimeout)
+		}
+	}
+}
+
+// slowServer - сервер, запрос к которому ждёт release
+func slowServer(t *testing.T) (*http.Server, net.Listener, chan struct{}, chan struct{}) {
+	t.Helper()
+	started, release := make(chan struct{}), make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := serverConfig{ReadTimeout: duration{time.Second}, WriteTimeout: duration{time.Second}, IdleTimeout: duration{time.Second}}
+	return newServer(cfg, handler, slog.New(slog.NewTextHandler(io.Discard, nil))), ln, started, release
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	srv, ln, started, release := slowServer(t)
+	// Shutdown вызывает хуки уже после закрытия слушателей
+	shuttingDown := make(chan struct{})
+	srv.RegisterOnShutdown(func() { close(shuttingDown) })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- runServer(ctx, srv, ln, time.Second) }()
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := client.Get("http://" + ln.Addr().String())
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		body <- string(data)
+	}()
+	<-started
+	cancel()
+
+	// новые соединения уже не принимаются, а начатый запрос дорабатывает
+	<-shuttingDown
+	if _, err := net.DialTimeout("tcp", ln.Addr().String(), 100*time.Millisecond); err == nil {
+		t.Errorf("server still accepts connections after shutdown started")
+	}
+	close(release)
+	if got := <-body; got != "done" {
+		t.Errorf("in-flight request was not drained: %q", got)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestShutdownDrainTimeout(t *testing.T) {
+	srv, ln, started, release := slowServer(t)
+	defer close(release)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- runServer(ctx, srv, ln, 50*time.Millisecond) }()
+
+	go client.Get("http://" + ln.Addr().String())
+	<-started
+	cancel()
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "shutdown") {
+		t.Errorf("expected shutdown timeout error, got %v", err)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user exists")
+	// ErrVersionConflict - пользователя успели изменить после того, как его прочитали
+	ErrVersionConflict = errors.New("user version conflict")
+)
+
+// UserStore - хранилище пользователей MyApi. Возвращает копии,
+// менять их можно свободно - в хранилище попадёт только то, что передали в Update
+type UserStore interface {
+	Get(ctx context.Context, login string) (*User, error)
+	// Create выдаёт пользователю ID и сохраняет его, если логин свободен
+	Create(ctx context.Context, user *User) (*User, error)
+	// List - до limit пользователей с ID больше afterID, по возрастанию ID
+	List(ctx context.Context, afterID uint64, limit int) ([]*User, error)
+	// Update заменяет пользователя с тем же логином, ID не меняется, Version
+	// растёт на 1. Ненулевой user.Version должен совпасть с текущим -
+	// иначе ErrVersionConflict, так два Get+Update не затрут друг друга
+	Update(ctx context.Context, user *User) (*User, error)
+	Delete(ctx context.Context, login string) error
+}
+
+// userRecord - одно изменение хранилища, строка журнала FileUserStore
+type userRecord struct {
+	Op    string `json:"op"`
+	User  *User  `json:"user,omitempty"`
+	Login string `json:"login,omitempty"`
+}
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+)
+
+// MemoryUserStore - пользователи в памяти, пропадают при перезапуске
+type MemoryUserStore struct {
+	mu     sync.RWMutex
+	users  map[string]*User
+	nextID uint64
+
+	// journal вызывается под блокировкой до применения изменения,
+	// если он вернул ошибку - изменение не применяется
+	journal func(rec userRecord) error
+}
+
+// NewMemoryUserStore - хранилище с начальными пользователями, ID им не меняются
+func NewMemoryUserStore(users ...*User) *MemoryUserStore {
+	store := &MemoryUserStore{users: map[string]*User{}, nextID: 1}
+	for _, user := range users {
+		seed := *user
+		if seed.Version == 0 {
+			seed.Version = 1
+		}
+		store.apply(userRecord{Op: opPut, User: &seed})
+	}
+	return store
+}
+
+func (st *MemoryUserStore) apply(rec userRecord) {
+	switch rec.Op {
+	case opPut:
+		user := *rec.User
+		st.users[user.Login] = &user
+		if user.ID >= st.nextID {
+			st.nextID = user.ID + 1
+		}
+	case opDelete:
+		delete(st.users, rec.Login)
+	}
+}
+
+func (st *MemoryUserStore) commit(rec userRecord) error {
+	if st.journal != nil {
+		if err := st.journal(rec); err != nil {
+			return err
+		}
+	}
+	st.apply(rec)
+	return nil
+}
+
+func (st *MemoryUserStore) Get(ctx context.Context, login string) (*User, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	user, exist := st.users[login]
+	if !exist {
+		return nil, ErrUserNotFound
+	}
+	res := *user
+	return &res, nil
+}
+
+func (st *MemoryUserStore) Create(ctx context.Context, user *User) (*User, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, exist := st.users[user.Login]; exist {
+		return nil, ErrUserExists
+	}
+	res := *user
+	res.ID = st.nextID
+	res.Version = 1
+	if err := st.commit(userRecord{Op: opPut, User: &res}); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (st *MemoryUserStore) List(ctx context.Context, afterID uint64, limit int) ([]*User, error) {
+	st.mu.RLock()
+	users := make([]*User, 0, len(st.users))
+	for _, user := range st.users {
+		if user.ID > afterID {
+			res := *user
+			users = append(users, &res)
+		}
+	}
+	st.mu.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	if limit >= 0 && len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+func (st *MemoryUserStore) Update(ctx context.Context, user *User) (*User, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	old, exist := st.users[user.Login]
+	if !exist {
+		return nil, ErrUserNotFound
+	}
+	if user.Version != 0 && user.Version != old.Version {
+		return nil, ErrVersionConflict
+	}
+	res := *user
+	res.ID = old.ID
+	res.Version = old.Version + 1
+	if err := st.commit(userRecord{Op: opPut, User: &res}); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func (st *MemoryUserStore) Delete(ctx context.Context, login string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, exist := st.users[login]; !exist {
+		return ErrUserNotFound
+	}
+	return st.commit(userRecord{Op: opDelete, Login: login})
+}
+
+// FileUserStore - те же пользователи в памяти плюс журнал на диске:
+// каждое изменение дописывается строкой json и сбрасывается fsync до ответа,
+// при открытии журнал проигрывается заново
+type FileUserStore struct {
+	*MemoryUserStore
+	file *os.File
+	// size - конец последней целой записи
+	size int64
+}
+
+// OpenFileUserStore открывает или создаёт журнал. Недописанную последнюю
+// строку (процесс упал посреди записи) отрезает, испорченную в середине - не прощает
+func OpenFileUserStore(path string) (*FileUserStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	store := &FileUserStore{MemoryUserStore: NewMemoryUserStore(), file: file}
+	if err := store.replay(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("replay %s: %w", path, err)
+	}
+	store.journal = store.write
+	return store, nil
+}
+
+func (st *FileUserStore) replay() error {
+	reader := bufio.NewReader(st.file)
+	var offset int64
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(data)) > 0 {
+				return st.truncate(offset)
+			}
+			st.size = offset
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var rec userRecord
+		if err := json.Unmarshal(data, &rec); err != nil || !rec.valid() {
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				return st.truncate(offset)
+			}
+			return fmt.Errorf("line %d: bad record %q", line, bytes.TrimSpace(data))
+		}
+		st.apply(rec)
+		offset += int64(len(data))
+	}
+}
+
+func (rec userRecord) valid() bool {
+	switch rec.Op {
+	case opPut:
+		return rec.User != nil && rec.User.Login != ""
+	case opDelete:
+		return rec.Login != ""
+	}
+	return false
+}
+
+func (st *FileUserStore) truncate(offset int64) error {
+	if err := st.file.Truncate(offset); err != nil {
+		return err
+	}
+	st.size = offset
+	_, err := st.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (st *FileUserStore) write(rec userRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if _, err = st.file.Write(data); err == nil {
+		err = st.file.Sync()
+	}
+	if err != nil {
+		// не оставляем обрывок записи, иначе следующие лягут за ним
+		st.truncate(st.size)
+		return err
+	}
+	st.size += int64(len(data))
+	return nil
+}
+
+func (st *FileUserStore) Close() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.file.Close()
+}
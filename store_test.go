@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testUserStore - общие для всех реализаций проверки UserStore
+func testUserStore(t *testing.T, store UserStore) {
+	ctx := context.Background()
+
+	first, err := store.Create(ctx, &User{Login: "first", FullName: "First"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := store.Create(ctx, &User{Login: "second", ID: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID != first.ID+1 {
+		t.Errorf("expected sequential ids, got %d and %d", first.ID, second.ID)
+	}
+	if _, err := store.Create(ctx, &User{Login: "first"}); !errors.Is(err, ErrUserExists) {
+		t.Errorf("expected ErrUserExists, got %v", err)
+	}
+
+	user, err := store.Get(ctx, "first")
+	if err != nil || user.FullName != "First" {
+		t.Fatalf("unexpected user %+v, err %v", user, err)
+	}
+	user.FullName = "changed outside"
+	if again, _ := store.Get(ctx, "first"); again.FullName != "First" {
+		t.Errorf("store returned its own copy: %+v", again)
+	}
+
+	updated, err := store.Update(ctx, &User{Login: "first", FullName: "Updated", ID: 777})
+	if err != nil || updated.ID != first.ID || updated.FullName != "Updated" {
+		t.Errorf("unexpected update result %+v, err %v", updated, err)
+	}
+	if updated.Version != first.Version+1 {
+		t.Errorf("expected version %d, got %d", first.Version+1, updated.Version)
+	}
+	if _, err := store.Update(ctx, &User{Login: "first", Version: first.Version}); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("expected ErrVersionConflict for stale version, got %v", err)
+	}
+	if _, err := store.Update(ctx, &User{Login: "nobody"}); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound on update, got %v", err)
+	}
+
+	users, err := store.List(ctx, 0, 10)
+	if err != nil || len(users) != 2 || users[0].Login != "first" || users[1].Login != "second" {
+		t.Errorf("unexpected list %v, err %v", users, err)
+	}
+	if users, _ := store.List(ctx, first.ID, 10); len(users) != 1 || users[0].Login != "second" {
+		t.Errorf("unexpected list after %d: %v", first.ID, users)
+	}
+	if users, _ := store.List(ctx, 0, 1); len(users) != 1 {
+		t.Errorf("limit ignored: %v", users)
+	}
+
+	if err := store.Delete(ctx, "first"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "first"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound after delete, got %v", err)
+	}
+	if err := store.Delete(ctx, "first"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound on second delete, got %v", err)
+	}
+}
+
+func TestMemoryUserStore(t *testing.T) {
+	testUserStore(t, NewMemoryUserStore())
+}
+
+func TestFileUserStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.log")
+	store, err := OpenFileUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testUserStore(t, store)
+	third, err := store.Create(context.Background(), &User{Login: "third"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// после перезапуска всё на месте, а ID не переиспользуются
+	store, err = OpenFileUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	users, _ := store.List(context.Background(), 0, -1)
+	if len(users) != 2 || users[0].Login != "second" || users[1].Login != "third" {
+		t.Errorf("unexpected users after replay %v", users)
+	}
+	next, err := store.Create(context.Background(), &User{Login: "fourth"})
+	if err != nil || next.ID != third.ID+1 {
+		t.Errorf("expected id %d, got %+v, err %v", third.ID+1, next, err)
+	}
+}
+
+func TestFileUserStoreTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.log")
+	log := `{"op":"put","user":{"id":1,"login":"kept","full_name":"","status":0}}` + "\n" +
+		`{"op":"put","user":{"id":2,"lo`
+	if err := os.WriteFile(path, []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := OpenFileUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Create(context.Background(), &User{Login: "after"}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	data, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[1], `"login":"after"`) {
+		t.Errorf("torn record was not cut off:\n%s", data)
+	}
+}
+
+func TestFileUserStoreCorrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.log")
+	log := "garbage\n" + `{"op":"delete","login":"kept"}` + "\n"
+	if err := os.WriteFile(path, []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFileUserStore(path); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("expected error about line 1, got %v", err)
+	}
+}
+
+func TestMyApiFileStore(t *testing.T) {
+	store, err := OpenFileUserStore(filepath.Join(t.TempDir(), "users.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	api := NewMyApiWithStore(store, testAuth)
+	res, err := api.Create(context.Background(), CreateParams{Login: "from_file_store", Status: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := api.Profile(context.Background(), ProfileParams{Login: "from_file_store"})
+	if err != nil || user.ID != res.ID || user.Status != statusAdmin {
+		t.Errorf("unexpected profile %+v, err %v", user, err)
+	}
+}
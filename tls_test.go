@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert - сертификат с ключом, подписанный parent (nil - самоподписанный)
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	tls  tls.Certificate
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, tmpl x509.Certificate) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl.SerialNumber = serial
+	tmpl.Subject = pkix.Name{CommonName: name}
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := &tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, tls: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}}
+}
+
+func newTestCA(t *testing.T, name string) *testCert {
+	return newTestCert(t, name, nil, x509.Certificate{
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+}
+
+// writePEM кладёт сертификат и ключ в dir, возвращает пути
+func (c *testCert) writePEM(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	certPath, keyPath := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key")
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+// startTLSServer - сервер из настроек с сертификатом для 127.0.0.1 и
+// центром клиентов clientCA
+func startTLSServer(t *testing.T, serverCA, clientCA *testCert) string {
+	t.Helper()
+	dir := t.TempDir()
+	server := newTestCert(t, "localhost", serverCA, x509.Certificate{
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	certPath, keyPath := server.writePEM(t, dir, "server")
+	caPath, _ := clientCA.writePEM(t, dir, "client-ca")
+
+	env := map[string]string{"API_AUTH_SECRETS": "test:secret", "API_TLS_CLIENT_CA": caPath}
+	cfg, err := loadConfig([]string{"-tls-cert", certPath, "-tls-key", keyPath}, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsCfg, err := cfg.Server.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	srv := newServer(cfg.Server, testHandler(t, cfg), logger)
+	srv.TLSConfig = tlsCfg
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- runServer(ctx, srv, ln, time.Second) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	return "https://" + ln.Addr().String()
+}
+
+func tlsClient(serverCA *testCert, cert *testCert) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCA.cert)
+	tlsCfg := &tls.Config{RootCAs: roots}
+	if cert != nil {
+		// отдаём сертификат, даже если сервер просит другой центр: иначе
+		// клиент молча придёт без него
+		tlsCfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &cert.tls, nil
+		}
+	}
+	return &http.Client{Timeout: time.Second, Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+}
+
+func TestMTLS(t *testing.T) {
+	serverCA, clientCA := newTestCA(t, "server ca"), newTestCA(t, "client ca")
+	url := startTLSServer(t, serverCA, clientCA)
+	clientAuth := x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	billing := newTestCert(t, "billing", clientCA, clientAuth)
+	stranger := newTestCert(t, "billing", newTestCA(t, "other ca"), clientAuth)
+
+	cases := []struct {
+		name      string
+		client    *http.Client
+		path      string
+		status    int
+		principal string
+	}{
+		{name: "whoami with cert", client: tlsClient(serverCA, billing), path: "/other/user/whoami", status: http.StatusOK, principal: "billing"},
+		{name: "whoami without cert", client: tlsClient(serverCA, nil), path: "/other/user/whoami", status: http.StatusForbidden},
+		// X-Auth за сертификат не сойдёт
+		{name: "whoami with X-Auth", client: tlsClient(serverCA, nil), path: "/other/user/whoami?x-auth=secret", status: http.StatusForbidden},
+		// остальным методам сертификат не нужен
+		{name: "profile without cert", client: tlsClient(serverCA, nil), path: "/user/profile?login=rvasily", status: http.StatusOK},
+		{name: "profile with cert", client: tlsClient(serverCA, billing), path: "/user/profile?login=rvasily", status: http.StatusOK},
+	}
+	for _, tc := range cases {
+		req, _ := http.NewRequest(http.MethodGet, url+tc.path, nil)
+		req.Header.Set("X-Auth", "secret")
+		resp, err := tc.client.Do(req)
+		if err != nil {
+			t.Errorf("[%s] %v", tc.name, err)
+			continue
+		}
+		var body struct {
+			Response Caller `json:"response"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("[%s] expected %d, got %d", tc.name, tc.status, resp.StatusCode)
+		}
+		if body.Response.Principal != tc.principal {
+			t.Errorf("[%s] expected principal %q, got %q", tc.name, tc.principal, body.Response.Principal)
+		}
+	}
+
+	// чужой центр: сервер рвёт соединение ещё до обработчика
+	resp, err := tlsClient(serverCA, stranger).Get(url + "/other/user/whoami")
+	if err == nil {
+		resp.Body.Close()
+		t.Errorf("expected handshake error for a certificate from an unknown CA, got %d", resp.StatusCode)
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := newTestCA(t, "server").writePEM(t, dir, "server")
+	junk := filepath.Join(dir, "junk.pem")
+	os.WriteFile(junk, []byte("not a pem"), 0600)
+
+	cases := []struct {
+		name string
+		tls  tlsConfig
+	}{
+		{"missing cert file", tlsConfig{Cert: filepath.Join(dir, "nope.pem"), Key: keyPath}},
+		{"key does not match", tlsConfig{Cert: certPath, Key: junk}},
+		{"missing client ca", tlsConfig{Cert: certPath, Key: keyPath, ClientCA: filepath.Join(dir, "nope.pem")}},
+		{"client ca without certs", tlsConfig{Cert: certPath, Key: keyPath, ClientCA: junk}},
+	}
+	for _, tc := range cases {
+		if _, err := (serverConfig{TLS: tc.tls}).tlsConfig(); err == nil {
+			t.Errorf("[%s] expected error", tc.name)
+		}
+	}
+	if tlsCfg, err := (serverConfig{}).tlsConfig(); tlsCfg != nil || err != nil {
+		t.Errorf("expected no tls without cert, got %v, %v", tlsCfg, err)
+	}
+}
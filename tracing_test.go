@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParseTraceparent(t *testing.T) {
+	cases := []struct {
+		header string
+		ok     bool
+	}{
+		{testTraceparent, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true},
+		// будущие версии разбираются по первым полям
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01", false},
+		{"garbage", false},
+		{"", false},
+	}
+	for _, tc := range cases {
+		sc, ok := ParseTraceparent(tc.header)
+		if ok != tc.ok {
+			t.Errorf("%q: expected ok=%v, got %v", tc.header, tc.ok, ok)
+		}
+		if ok && tc.header == testTraceparent && sc.Traceparent() != testTraceparent {
+			t.Errorf("round trip: %q", sc.Traceparent())
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	tracer := NewMemoryTracer()
+	api := NewMyApi(testAuth).WithTracer(tracer)
+
+	requests := []struct {
+		url         string
+		traceparent string
+	}{
+		{ApiUserProfile + "?login=rvasily", testTraceparent},
+		{ApiUserProfile, ""},
+		{ApiUserProfile + "?login=nobody", ""},
+	}
+	for _, req := range requests {
+		r := httptest.NewRequest(http.MethodGet, req.url, nil)
+		if req.traceparent != "" {
+			r.Header.Set("traceparent", req.traceparent)
+		}
+		api.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	spans := tracer.Spans()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+
+	ok := spans[0]
+	parent, _ := ParseTraceparent(testTraceparent)
+	if ok.Name != "MyApi.Profile" || ok.Parent != parent || ok.SpanContext.TraceID != parent.TraceID || ok.SpanContext.SpanID == parent.SpanID {
+		t.Errorf("span does not continue the incoming trace: %+v", ok)
+	}
+	if ok.Attributes["http.response.status_code"] != http.StatusOK || ok.Attributes["apigen.endpoint"] != "Profile" || len(ok.Events) != 0 {
+		t.Errorf("unexpected ok span %+v", ok)
+	}
+
+	invalid := spans[1]
+	if invalid.Parent.IsValid() || !invalid.SpanContext.IsValid() || invalid.SpanContext.TraceID == parent.TraceID {
+		t.Errorf("expected new trace, got %+v", invalid)
+	}
+	if len(invalid.Events) != 1 || invalid.Events[0].Name != "validation_error" || invalid.Events[0].Attributes["param"] != "login" {
+		t.Errorf("expected validation_error event, got %+v", invalid.Events)
+	}
+
+	notFound := spans[2]
+	if notFound.Attributes["http.response.status_code"] != http.StatusNotFound || notFound.Attributes["apigen.error_code"] != "user_not_found" {
+		t.Errorf("unexpected attributes %v", notFound.Attributes)
+	}
+	if len(notFound.Events) != 1 || notFound.Events[0].Name != "error" {
+		t.Errorf("expected error event, got %+v", notFound.Events)
+	}
+}
+
+func TestTracingNoop(t *testing.T) {
+	// без трейсера trace из запроса не рвётся: span из контекста отдаёт родителя
+	ctx := context.Background()
+	parent, _ := ParseTraceparent(testTraceparent)
+	ctx = ContextWithSpan(ctx, noopTracer{}.Start(ctx, "test", parent))
+
+	header := http.Header{}
+	InjectTraceparent(ctx, header)
+	if header.Get("traceparent") != testTraceparent {
+		t.Errorf("expected %q, got %q", testTraceparent, header.Get("traceparent"))
+	}
+
+	header = http.Header{}
+	InjectTraceparent(context.Background(), header)
+	if _, ok := header["Traceparent"]; ok {
+		t.Errorf("traceparent injected without span: %v", header)
+	}
+}